@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+)
+
+var (
+	resourceLockName = ".lock"
+	//the lock is re-entrant within a process, flock would block on a second
+	//descriptor for the same file
+	resourceLockFile  *os.File
+	resourceLockDepth int
+)
+
+// lockResources takes an exclusive advisory lock on the resource directory,
+// blocking until other vpn processes release it, and returns the unlock func
+func lockResources() func() {
+	if resourceLockDepth == 0 {
+		lockFile, err := os.OpenFile(path.Join(resourcePath, resourceLockName), os.O_CREATE|os.O_RDWR, 0600)
+		if err != nil {
+			log.Fatalf("Could not open lock file in %s: %s", resourcePath, err)
+		}
+		err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX)
+		if err != nil {
+			log.Fatalf("Could not lock %s: %s", resourcePath, err)
+		}
+		resourceLockFile = lockFile
+	}
+	resourceLockDepth++
+	return func() {
+		resourceLockDepth--
+		if resourceLockDepth == 0 {
+			syscall.Flock(int(resourceLockFile.Fd()), syscall.LOCK_UN)
+			resourceLockFile.Close()
+			resourceLockFile = nil
+		}
+	}
+}
+
+// writeFileAtomic writes data to a temporary file next to filePath, syncs it
+// and renames it into place so readers never see a partially written file
+func writeFileAtomic(filePath string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(filePath)
+	tmpFile, err := ioutil.TempFile(dir, "."+filepath.Base(filePath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	err = tmpFile.Chmod(perm)
+	if err == nil {
+		_, err = tmpFile.Write(data)
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFile.Name(), filePath)
+	if err != nil {
+		return err
+	}
+	if dirFile, err := os.Open(dir); err == nil {
+		dirFile.Sync()
+		dirFile.Close()
+	}
+	return nil
+}
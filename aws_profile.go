@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/go-ini/ini"
-	"io/ioutil"
 	"log"
 	"os"
 	"path"
@@ -12,7 +11,7 @@ import (
 
 var (
 	awsProfileNamesPath   = path.Join(resourcePath, "aws_profile_names.json")
-	awsCredentialFilePath = path.Join(os.Getenv("HOME"), ".aws", "credentials")
+	awsCredentialFilePath = config.AWS.CredentialsFile
 )
 
 func existingProfiles() bool {
@@ -48,15 +47,11 @@ func writeAWSProfileFile(profileNames []string) {
 		fmt.Println(err)
 		return
 	}
-	writeError := ioutil.WriteFile(awsProfileNamesPath, profileNamesJSON, 0755)
-	if writeError != nil {
-		fmt.Print("Could not write AWS profile names to config file\n")
-		log.Fatal(writeError)
-	}
+	writeResourceFile(awsProfileNamesPath, profileNamesJSON)
 }
 
 func readAWSProfileFile() ([]string, error) {
-	file, e := ioutil.ReadFile(awsProfileNamesPath)
+	file, e := readResourceFile(awsProfileNamesPath)
 	if e != nil {
 		if noSuchFileErrRegexp.MatchString(e.Error()) {
 			return []string{}, e
@@ -72,31 +67,15 @@ func readAWSProfileFile() ([]string, error) {
 	return awsProfiles, nil
 }
 
-func detail4Capture(attr string) string {
-	var response string
-	fmt.Printf("%s ", attr)
-	_, err := fmt.Scanln(&response)
-	if err != nil {
-		if err.Error() == "unexpected newline" {
-			return ""
-		}
-		log.Fatal(err)
-	}
-	return response
-}
-
 func confirmUserSelection(userPrompt string) bool {
-	var returnVar bool
-	confirmation := detail4Capture(userPrompt)
-	switch confirmation {
-	case "y":
-		returnVar = true
-	case "n":
-		returnVar = false
-	default:
-		confirmUserSelection(userPrompt)
+	for {
+		switch detailCapture(userPrompt) {
+		case "y":
+			return true
+		case "n":
+			return false
+		}
 	}
-	return returnVar
 }
 
 func setupProfiles() {
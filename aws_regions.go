@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+var (
+	awsRegionCachePath = path.Join(resourcePath, "aws_regions.json")
+	enabledOptInStatus = []string{"opt-in-not-required", "opted-in"}
+)
+
+type awsRegionCacheEntry struct {
+	Regions   []string  `json:"regions"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+type awsRegionCache map[string]awsRegionCacheEntry
+
+func describeRegions(profile string) []string {
+	fmt.Printf("discovering enabled regions for profile: %s\n", profile)
+	svc := ec2Client(profile, config.AWS.DiscoveryRegion)
+	resp, err := svc.DescribeRegions(&ec2.DescribeRegionsInput{
+		AllRegions: aws.Bool(true),
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("opt-in-status"),
+				Values: aws.StringSlice(enabledOptInStatus),
+			},
+		},
+	})
+	if err != nil {
+		fmt.Println("there was an error discovering regions for profile", profile, err.Error())
+		log.Fatal(err.Error())
+	}
+	var regions []string
+	for _, region := range resp.Regions {
+		regions = append(regions, *region.RegionName)
+	}
+	sort.Strings(regions)
+	return regions
+}
+
+func loadRegionCache() awsRegionCache {
+	cache := make(awsRegionCache)
+	file, e := ioutil.ReadFile(awsRegionCachePath)
+	if e != nil {
+		if os.IsNotExist(e) {
+			return cache
+		}
+		log.Fatalf("Could not read region cache %s: %s", awsRegionCachePath, e)
+	}
+	err := json.Unmarshal(file, &cache)
+	if err != nil {
+		fmt.Printf("Ignoring unreadable region cache %s\n", awsRegionCachePath)
+		return make(awsRegionCache)
+	}
+	return cache
+}
+
+func writeRegionCache(cache awsRegionCache) {
+	cacheJSON, err := json.Marshal(cache)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	unlock := lockResources()
+	defer unlock()
+	writeError := writeFileAtomic(awsRegionCachePath, cacheJSON, 0644)
+	if writeError != nil {
+		fmt.Printf("Could not write region cache to path %s\n", awsRegionCachePath)
+		log.Fatal(writeError)
+	}
+}
+
+// filterRegions applies the include and exclude lists from the config file,
+// a non-empty include list replaces the discovered regions entirely
+func filterRegions(regions []string, regionConfig awsRegionConfig) []string {
+	if len(regionConfig.Include) > 0 {
+		regions = regionConfig.Include
+	}
+	excluded := make(map[string]bool)
+	for _, region := range regionConfig.Exclude {
+		excluded[region] = true
+	}
+	var filtered []string
+	for _, region := range regions {
+		if !excluded[region] {
+			filtered = append(filtered, region)
+		}
+	}
+	return filtered
+}
+
+// awsRegions returns the regions to search for the given AWS profile,
+// discovered regions are cached for regionConfig.CacheTTL
+func awsRegions(profile string, forceDiscovery bool) []string {
+	regionConfig := config.Regions
+	if len(regionConfig.Include) > 0 {
+		return filterRegions(nil, regionConfig)
+	}
+	cache := loadRegionCache()
+	entry, cached := cache[profile]
+	if forceDiscovery || !cached || time.Since(entry.FetchedAt) > regionConfig.CacheTTL {
+		entry = awsRegionCacheEntry{
+			Regions:   describeRegions(profile),
+			FetchedAt: time.Now(),
+		}
+		cache[profile] = entry
+		writeRegionCache(cache)
+	}
+	return filterRegions(entry.Regions, regionConfig)
+}
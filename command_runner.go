@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os/exec"
+)
+
+// commandRunner runs external commands, every shell-out goes through runner
+// so tests can script and record the commands with a recordingRunner
+type commandRunner interface {
+	// Run runs the command, discarding its output
+	Run(name string, args ...string) error
+	// Output runs the command and returns its stdout
+	Output(name string, args ...string) ([]byte, error)
+	// CombinedOutput runs the command and returns its stdout and stderr
+	CombinedOutput(name string, args ...string) ([]byte, error)
+}
+
+var runner commandRunner = execRunner{}
+
+// execRunner runs commands with os/exec
+type execRunner struct{}
+
+func (r execRunner) Run(name string, args ...string) error {
+	return exec.Command(name, args...).Run()
+}
+
+func (r execRunner) Output(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).Output()
+}
+
+func (r execRunner) CombinedOutput(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
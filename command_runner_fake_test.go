@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// recordingRunner is a commandRunner that never runs anything, it records
+// each command line it is given and answers with scripted stdout and exit
+// codes. Commands that have not been scripted succeed with no output
+type recordingRunner struct {
+	mu        sync.Mutex
+	Calls     []string
+	once      []scriptedCommand
+	responses []scriptedCommand
+}
+
+// scriptedCommand is the response to any command line starting with prefix
+type scriptedCommand struct {
+	prefix   string
+	stdout   string
+	exitCode int
+}
+
+// fakeExitError is returned for scripted commands with a non-zero exit code
+type fakeExitError struct {
+	commandLine string
+	exitCode    int
+}
+
+func (e fakeExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.exitCode)
+}
+
+func newRecordingRunner() *recordingRunner {
+	return &recordingRunner{}
+}
+
+// On scripts the response to every command line starting with prefix, when
+// several prefixes match the one scripted last wins
+func (r *recordingRunner) On(prefix string, stdout string, exitCode int) *recordingRunner {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.responses = append(r.responses, scriptedCommand{prefix, stdout, exitCode})
+	return r
+}
+
+// Once scripts the response to the next command line starting with prefix,
+// once responses are used in the order they were scripted and take
+// precedence over responses scripted with On
+func (r *recordingRunner) Once(prefix string, stdout string, exitCode int) *recordingRunner {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.once = append(r.once, scriptedCommand{prefix, stdout, exitCode})
+	return r
+}
+
+// Ran returns the recorded command lines starting with prefix
+func (r *recordingRunner) Ran(prefix string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var matched []string
+	for _, call := range r.Calls {
+		if strings.HasPrefix(call, prefix) {
+			matched = append(matched, call)
+		}
+	}
+	return matched
+}
+
+func (r *recordingRunner) respond(name string, args []string) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	commandLine := strings.Join(append([]string{name}, args...), " ")
+	r.Calls = append(r.Calls, commandLine)
+	response, found := scriptedCommand{}, false
+	for index, scripted := range r.once {
+		if strings.HasPrefix(commandLine, scripted.prefix) {
+			response, found = scripted, true
+			r.once = append(r.once[:index], r.once[index+1:]...)
+			break
+		}
+	}
+	for index := len(r.responses) - 1; !found && index >= 0; index-- {
+		if strings.HasPrefix(commandLine, r.responses[index].prefix) {
+			response, found = r.responses[index], true
+		}
+	}
+	if response.exitCode != 0 {
+		return []byte(response.stdout), fakeExitError{commandLine, response.exitCode}
+	}
+	return []byte(response.stdout), nil
+}
+
+func (r *recordingRunner) Run(name string, args ...string) error {
+	_, err := r.respond(name, args)
+	return err
+}
+
+func (r *recordingRunner) Output(name string, args ...string) ([]byte, error) {
+	return r.respond(name, args)
+}
+
+func (r *recordingRunner) CombinedOutput(name string, args ...string) ([]byte, error) {
+	return r.respond(name, args)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"sort"
+	"strings"
+)
+
+// defaultDiscoveryFilter matches the instances found before discovery
+// became configurable, running instances with vpn in their Name tag
+var defaultDiscoveryFilter = discoveryFilter{
+	Tags:           map[string]string{"Name": "*vpn*"},
+	States:         []string{"running"},
+	NameTag:        "Name",
+	EnvironmentTag: "environment",
+}
+
+type discoveryConfig struct {
+	Default  discoveryFilter            `yaml:"default"`
+	Profiles map[string]discoveryFilter `yaml:"profiles"`
+}
+
+// discoveryFilter selects which EC2 instances are VPN hosts and which of
+// their tags populate vpnInstance. Tag values are EC2 filter globs.
+type discoveryFilter struct {
+	Tags           map[string]string `yaml:"tags,omitempty" json:"tags,omitempty"`
+	States         []string          `yaml:"states,omitempty" json:"states,omitempty"`
+	VpcIDs         []string          `yaml:"vpc_ids,omitempty" json:"vpc_ids,omitempty"`
+	NameTag        string            `yaml:"name_tag,omitempty" json:"name_tag,omitempty"`
+	EnvironmentTag string            `yaml:"environment_tag,omitempty" json:"environment_tag,omitempty"`
+}
+
+// merge fills unset fields of f from fallback
+func (f discoveryFilter) merge(fallback discoveryFilter) discoveryFilter {
+	if len(f.Tags) == 0 {
+		f.Tags = fallback.Tags
+	}
+	if len(f.States) == 0 {
+		f.States = fallback.States
+	}
+	if len(f.VpcIDs) == 0 {
+		f.VpcIDs = fallback.VpcIDs
+	}
+	if f.NameTag == "" {
+		f.NameTag = fallback.NameTag
+	}
+	if f.EnvironmentTag == "" {
+		f.EnvironmentTag = fallback.EnvironmentTag
+	}
+	return f
+}
+
+// forProfile resolves the filter for an AWS profile, falling back to the
+// configured default and then the built in filter
+func (c discoveryConfig) forProfile(profile string) discoveryFilter {
+	return c.Profiles[profile].merge(c.Default).merge(defaultDiscoveryFilter)
+}
+
+func (f discoveryFilter) instanceFilters() []*ec2.Filter {
+	var filters []*ec2.Filter
+	for _, key := range f.tagKeys() {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String(fmt.Sprintf("tag:%s", key)),
+			Values: []*string{aws.String(f.Tags[key])},
+		})
+	}
+	if len(f.States) > 0 {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("instance-state-name"),
+			Values: aws.StringSlice(f.States),
+		})
+	}
+	if len(f.VpcIDs) > 0 {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("vpc-id"),
+			Values: aws.StringSlice(f.VpcIDs),
+		})
+	}
+	return filters
+}
+
+func (f discoveryFilter) tagKeys() []string {
+	var keys []string
+	for key := range f.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f discoveryFilter) String() string {
+	var tags []string
+	for _, key := range f.tagKeys() {
+		tags = append(tags, fmt.Sprintf("%s=%s", key, f.Tags[key]))
+	}
+	return strings.Join(tags, ",")
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+)
+
+// hostProfileRule maps hosts to the VPN profile used to connect to them,
+// every field set on a rule must match. Name is a glob.
+type hostProfileRule struct {
+	Environment string `yaml:"environment,omitempty"`
+	Name        string `yaml:"name,omitempty"`
+	VpcID       string `yaml:"vpc_id,omitempty"`
+	AWSProfile  string `yaml:"aws_profile,omitempty"`
+	Profile     string `yaml:"profile"`
+}
+
+func (r hostProfileRule) matches(vpnHost vpnInstance) bool {
+	if r.Environment != "" && r.Environment != vpnHost.Environment {
+		return false
+	}
+	if r.Name != "" {
+		matched, err := path.Match(r.Name, vpnHost.Name)
+		if err != nil {
+			log.Fatalf("Invalid host_profiles name pattern %s: %s", r.Name, err)
+		}
+		if !matched {
+			return false
+		}
+	}
+	if r.VpcID != "" && r.VpcID != vpnHost.VpcID {
+		return false
+	}
+	if r.AWSProfile != "" && r.AWSProfile != vpnHost.AWSProfile {
+		return false
+	}
+	return true
+}
+
+// profileForHost returns the profile of the first host_profiles rule that
+// matches vpnHost
+func profileForHost(vpnHost vpnInstance) string {
+	for _, rule := range config.HostProfiles {
+		if rule.Profile != "" && rule.matches(vpnHost) {
+			fmt.Printf("Using profile %s for %s\n", rule.Profile, vpnHost.Name)
+			return rule.Profile
+		}
+	}
+	log.Fatalf("No profile provided and no host_profiles rule matches %s, use -p to choose one", vpnHost.Name)
+	return ""
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// managedHostMarker is appended to hosts file lines written by vpn
+const managedHostMarker = "# managed by vpn"
+
+// hostsFile is a hosts file held as its raw lines, so that comments,
+// blank lines and ordering survive an edit
+type hostsFile struct {
+	path     string
+	original []string
+	lines    []string
+}
+
+func loadHostsFile(filePath string) (*hostsFile, error) {
+	file, err := ioutil.ReadFile(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var lines []string
+	if len(file) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(file), "\n"), "\n")
+	}
+	return &hostsFile{
+		path:     filePath,
+		original: append([]string(nil), lines...),
+		lines:    lines,
+	}, nil
+}
+
+// parseHostsLine returns the address and host names of a hosts file entry,
+// comments and blank lines have no address
+func parseHostsLine(line string) (string, []string) {
+	if comment := strings.Index(line, "#"); comment >= 0 {
+		line = line[:comment]
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return "", nil
+	}
+	return fields[0], fields[1:]
+}
+
+func (h *hostsFile) lineMaps(index int, host string) bool {
+	_, names := parseHostsLine(h.lines[index])
+	for _, name := range names {
+		if name == host {
+			return true
+		}
+	}
+	return false
+}
+
+// address returns the address host points to, or an empty string
+func (h *hostsFile) address(host string) string {
+	for index, line := range h.lines {
+		if h.lineMaps(index, host) {
+			address, _ := parseHostsLine(line)
+			return address
+		}
+	}
+	return ""
+}
+
+// withoutHost returns line with host dropped from its names, the address,
+// the other names and any comment are kept. It reports false when host was
+// the only name on the line
+func withoutHost(line string, host string) (string, bool) {
+	address, names := parseHostsLine(line)
+	var kept []string
+	for _, name := range names {
+		if name != host {
+			kept = append(kept, name)
+		}
+	}
+	if len(kept) == 0 {
+		return "", false
+	}
+	edited := fmt.Sprintf("%s\t%s", address, strings.Join(kept, " "))
+	if comment := strings.Index(line, "#"); comment >= 0 {
+		edited += " " + line[comment:]
+	}
+	return edited, true
+}
+
+// setManagedHost points host at address with a single line tagged with
+// managedHostMarker, written where host first appeared. Lines sharing host
+// with other names keep the other names
+func (h *hostsFile) setManagedHost(address string, host string) {
+	entry := fmt.Sprintf("%s\t%s %s", address, host, managedHostMarker)
+	var lines []string
+	written := false
+	for index, line := range h.lines {
+		if !h.lineMaps(index, host) {
+			lines = append(lines, line)
+			continue
+		}
+		if edited, kept := withoutHost(line, host); kept {
+			lines = append(lines, edited)
+		}
+		if !written {
+			lines = append(lines, entry)
+			written = true
+		}
+	}
+	if !written {
+		lines = append(lines, entry)
+	}
+	h.lines = lines
+}
+
+// removeManagedHost drops host from every line, lines left without a name
+// are removed
+func (h *hostsFile) removeManagedHost(host string) {
+	var lines []string
+	for index, line := range h.lines {
+		if !h.lineMaps(index, host) {
+			lines = append(lines, line)
+			continue
+		}
+		if edited, kept := withoutHost(line, host); kept {
+			lines = append(lines, edited)
+		}
+	}
+	h.lines = lines
+}
+
+func (h *hostsFile) changed() bool {
+	return strings.Join(h.original, "\n") != strings.Join(h.lines, "\n")
+}
+
+// diffContext is the number of unchanged lines shown around each change
+const diffContext = 3
+
+// diffLine is a line of a diff, op is ' ' for a line kept, '-' for a line
+// removed and '+' for a line added
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// diffLines returns the edit from original to edited that keeps their
+// longest common subsequence in place
+func diffLines(original []string, edited []string) []diffLine {
+	common := make([][]int, len(original)+1)
+	for i := range common {
+		common[i] = make([]int, len(edited)+1)
+	}
+	for i := len(original) - 1; i >= 0; i-- {
+		for j := len(edited) - 1; j >= 0; j-- {
+			switch {
+			case original[i] == edited[j]:
+				common[i][j] = common[i+1][j+1] + 1
+			case common[i+1][j] >= common[i][j+1]:
+				common[i][j] = common[i+1][j]
+			default:
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+	var lines []diffLine
+	i, j := 0, 0
+	for i < len(original) || j < len(edited) {
+		switch {
+		case i < len(original) && j < len(edited) && original[i] == edited[j]:
+			lines = append(lines, diffLine{' ', original[i]})
+			i++
+			j++
+		case j == len(edited) || (i < len(original) && common[i+1][j] >= common[i][j+1]):
+			lines = append(lines, diffLine{'-', original[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', edited[j]})
+			j++
+		}
+	}
+	return lines
+}
+
+// hunkRange formats the start and length of a hunk side, an empty side
+// starts at the line before it
+func hunkRange(start int, length int) string {
+	switch length {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
+
+// diff describes the pending edit as a unified diff
+func (h *hostsFile) diff() string {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", h.path, h.path)
+	lines := diffLines(h.original, h.lines)
+	//line numbers in the original and edited file before each diff line
+	originalAt, editedAt := make([]int, len(lines)+1), make([]int, len(lines)+1)
+	var changes []int
+	for index, line := range lines {
+		originalAt[index+1], editedAt[index+1] = originalAt[index], editedAt[index]
+		if line.op != '+' {
+			originalAt[index+1]++
+		}
+		if line.op != '-' {
+			editedAt[index+1]++
+		}
+		if line.op != ' ' {
+			changes = append(changes, index)
+		}
+	}
+	for len(changes) > 0 {
+		//changes closer than twice the context share a hunk
+		last := 0
+		for last+1 < len(changes) && changes[last+1]-changes[last] <= 2*diffContext+1 {
+			last++
+		}
+		start := changes[0] - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := changes[last] + diffContext + 1
+		if end > len(lines) {
+			end = len(lines)
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n",
+			hunkRange(originalAt[start], originalAt[end]-originalAt[start]),
+			hunkRange(editedAt[start], editedAt[end]-editedAt[start]))
+		for _, line := range lines[start:end] {
+			fmt.Fprintf(&out, "%c%s\n", line.op, line.text)
+		}
+		changes = changes[last+1:]
+	}
+	return out.String()
+}
+
+// save writes the edited hosts file, or prints the diff when dryRun is set.
+// Symlinks are followed so the link to the hosts file on OSX is kept
+func (h *hostsFile) save(dryRun bool) error {
+	if !h.changed() {
+		return nil
+	}
+	if dryRun {
+		fmt.Print(h.diff())
+		return nil
+	}
+	target := h.path
+	if resolved, err := filepath.EvalSymlinks(h.path); err == nil {
+		target = resolved
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(target); err == nil {
+		mode = info.Mode().Perm()
+	}
+	content := strings.Join(h.lines, "\n")
+	if len(h.lines) > 0 {
+		content += "\n"
+	}
+	err := writeFileAtomic(target, []byte(content), mode)
+	if err != nil {
+		return err
+	}
+	h.original = append([]string(nil), h.lines...)
+	return nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testHostsFile(lines ...string) *hostsFile {
+	return &hostsFile{
+		path:     "/etc/hosts",
+		original: append([]string(nil), lines...),
+		lines:    append([]string(nil), lines...),
+	}
+}
+
+func TestSetManagedHost(t *testing.T) {
+	entry := "203.0.113.10\tmanagedvpn.local # managed by vpn"
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string
+	}{
+		{
+			name:  "empty file",
+			lines: nil,
+			want:  []string{entry},
+		},
+		{
+			name:  "appended after comments and blank lines",
+			lines: []string{"# hosts", "127.0.0.1\tlocalhost", ""},
+			want:  []string{"# hosts", "127.0.0.1\tlocalhost", "", entry},
+		},
+		{
+			name:  "managed line replaced in place",
+			lines: []string{"127.0.0.1\tlocalhost", "198.51.100.1\tmanagedvpn.local # managed by vpn", "::1\tlocalhost"},
+			want:  []string{"127.0.0.1\tlocalhost", entry, "::1\tlocalhost"},
+		},
+		{
+			name:  "duplicates collapsed to the first position",
+			lines: []string{"198.51.100.1 managedvpn.local", "127.0.0.1 localhost", "198.51.100.2 managedvpn.local"},
+			want:  []string{entry, "127.0.0.1 localhost"},
+		},
+		{
+			name:  "shared line keeps other names",
+			lines: []string{"198.51.100.1 intranet managedvpn.local wiki # office", "127.0.0.1 localhost"},
+			want:  []string{"198.51.100.1\tintranet wiki # office", entry, "127.0.0.1 localhost"},
+		},
+		{
+			name:  "commented out entry left alone",
+			lines: []string{"# 198.51.100.1 managedvpn.local"},
+			want:  []string{"# 198.51.100.1 managedvpn.local", entry},
+		},
+		{
+			name:  "similar names left alone",
+			lines: []string{"198.51.100.1 managedvpn.local.example managedvpn-2.local"},
+			want:  []string{"198.51.100.1 managedvpn.local.example managedvpn-2.local", entry},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hosts := testHostsFile(test.lines...)
+			hosts.setManagedHost("203.0.113.10", "managedvpn.local")
+			if !reflect.DeepEqual(hosts.lines, test.want) {
+				t.Errorf("lines = %q, want %q", hosts.lines, test.want)
+			}
+			if got := hosts.address("managedvpn.local"); got != "203.0.113.10" {
+				t.Errorf("address = %q, want 203.0.113.10", got)
+			}
+		})
+	}
+}
+
+func TestRemoveManagedHost(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string
+	}{
+		{
+			name:  "not present",
+			lines: []string{"# hosts", "127.0.0.1 localhost"},
+			want:  []string{"# hosts", "127.0.0.1 localhost"},
+		},
+		{
+			name:  "managed line removed",
+			lines: []string{"127.0.0.1 localhost", "203.0.113.10\tmanagedvpn.local # managed by vpn", "", "::1 localhost"},
+			want:  []string{"127.0.0.1 localhost", "", "::1 localhost"},
+		},
+		{
+			name:  "every entry removed",
+			lines: []string{"198.51.100.1 managedvpn.local", "198.51.100.2 managedvpn.local"},
+			want:  nil,
+		},
+		{
+			name:  "shared line keeps other names",
+			lines: []string{"198.51.100.1 managedvpn.local wiki # office", "127.0.0.1 localhost"},
+			want:  []string{"198.51.100.1\twiki # office", "127.0.0.1 localhost"},
+		},
+		{
+			name:  "other slots left alone",
+			lines: []string{"203.0.113.10\tmanagedvpn.local # managed by vpn", "203.0.113.20\tmanagedvpn-2.local # managed by vpn"},
+			want:  []string{"203.0.113.20\tmanagedvpn-2.local # managed by vpn"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hosts := testHostsFile(test.lines...)
+			hosts.removeManagedHost("managedvpn.local")
+			if !reflect.DeepEqual(hosts.lines, test.want) {
+				t.Errorf("lines = %q, want %q", hosts.lines, test.want)
+			}
+			if got := hosts.address("managedvpn.local"); got != "" {
+				t.Errorf("address = %q, want no entry", got)
+			}
+		})
+	}
+}
+
+func TestHostsFileDiff(t *testing.T) {
+	tests := []struct {
+		name   string
+		lines  []string
+		edit   func(hosts *hostsFile)
+		want   string
+		change bool
+	}{
+		{
+			name:  "unchanged",
+			lines: []string{"127.0.0.1 localhost", "203.0.113.10\tmanagedvpn.local # managed by vpn"},
+			edit:  func(hosts *hostsFile) { hosts.setManagedHost("203.0.113.10", "managedvpn.local") },
+			want:  "--- /etc/hosts\n+++ /etc/hosts\n",
+		},
+		{
+			name:   "added",
+			lines:  []string{"127.0.0.1 localhost"},
+			edit:   func(hosts *hostsFile) { hosts.setManagedHost("203.0.113.10", "managedvpn.local") },
+			want:   "--- /etc/hosts\n+++ /etc/hosts\n@@ -1 +1,2 @@\n 127.0.0.1 localhost\n+203.0.113.10\tmanagedvpn.local # managed by vpn\n",
+			change: true,
+		},
+		{
+			name:   "repointed",
+			lines:  []string{"198.51.100.1\tmanagedvpn.local # managed by vpn", "127.0.0.1 localhost"},
+			edit:   func(hosts *hostsFile) { hosts.setManagedHost("203.0.113.10", "managedvpn.local") },
+			want:   "--- /etc/hosts\n+++ /etc/hosts\n@@ -1,2 +1,2 @@\n-198.51.100.1\tmanagedvpn.local # managed by vpn\n+203.0.113.10\tmanagedvpn.local # managed by vpn\n 127.0.0.1 localhost\n",
+			change: true,
+		},
+		{
+			name:   "shared line split",
+			lines:  []string{"198.51.100.1 wiki managedvpn.local"},
+			edit:   func(hosts *hostsFile) { hosts.setManagedHost("203.0.113.10", "managedvpn.local") },
+			want:   "--- /etc/hosts\n+++ /etc/hosts\n@@ -1 +1,2 @@\n-198.51.100.1 wiki managedvpn.local\n+198.51.100.1\twiki\n+203.0.113.10\tmanagedvpn.local # managed by vpn\n",
+			change: true,
+		},
+		{
+			name:   "duplicate blank lines kept",
+			lines:  []string{"", "203.0.113.10\tmanagedvpn.local # managed by vpn", ""},
+			edit:   func(hosts *hostsFile) { hosts.removeManagedHost("managedvpn.local") },
+			want:   "--- /etc/hosts\n+++ /etc/hosts\n@@ -1,3 +1,2 @@\n \n-203.0.113.10\tmanagedvpn.local # managed by vpn\n \n",
+			change: true,
+		},
+		{
+			name:   "reordered",
+			lines:  []string{"127.0.0.1 localhost", "::1 localhost"},
+			edit:   func(hosts *hostsFile) { hosts.lines = []string{"::1 localhost", "127.0.0.1 localhost"} },
+			want:   "--- /etc/hosts\n+++ /etc/hosts\n@@ -1,2 +1,2 @@\n-127.0.0.1 localhost\n ::1 localhost\n+127.0.0.1 localhost\n",
+			change: true,
+		},
+		{
+			name:   "every line removed",
+			lines:  []string{"203.0.113.10\tmanagedvpn.local # managed by vpn"},
+			edit:   func(hosts *hostsFile) { hosts.removeManagedHost("managedvpn.local") },
+			want:   "--- /etc/hosts\n+++ /etc/hosts\n@@ -1 +0,0 @@\n-203.0.113.10\tmanagedvpn.local # managed by vpn\n",
+			change: true,
+		},
+		{
+			name: "hunks with context",
+			lines: []string{
+				"198.51.100.1 managedvpn.local", "# 2", "# 3", "# 4", "# 5", "# 6", "# 7", "# 8", "# 9", "# 10", "# 11",
+				"198.51.100.2 managedvpn-2.local",
+			},
+			edit: func(hosts *hostsFile) {
+				hosts.setManagedHost("203.0.113.10", "managedvpn.local")
+				hosts.setManagedHost("203.0.113.20", "managedvpn-2.local")
+			},
+			want: "--- /etc/hosts\n+++ /etc/hosts\n" +
+				"@@ -1,4 +1,4 @@\n-198.51.100.1 managedvpn.local\n+203.0.113.10\tmanagedvpn.local # managed by vpn\n # 2\n # 3\n # 4\n" +
+				"@@ -9,4 +9,4 @@\n # 9\n # 10\n # 11\n-198.51.100.2 managedvpn-2.local\n+203.0.113.20\tmanagedvpn-2.local # managed by vpn\n",
+			change: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hosts := testHostsFile(test.lines...)
+			test.edit(hosts)
+			if got := hosts.diff(); got != test.want {
+				t.Errorf("diff =\n%s\nwant\n%s", got, test.want)
+			}
+			if hosts.changed() != test.change {
+				t.Errorf("changed() = %v, want %v", hosts.changed(), test.change)
+			}
+		})
+	}
+}
+
+func TestHostsFileSave(t *testing.T) {
+	hostsPath := path.Join(t.TempDir(), "hosts")
+	original := "# hosts\n127.0.0.1 localhost wiki\n\n198.51.100.1 wiki managedvpn.local\n"
+	err := ioutil.WriteFile(hostsPath, []byte(original), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := loadHostsFile(hostsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hosts.setManagedHost("203.0.113.10", "managedvpn.local")
+	if err := hosts.save(true); err != nil {
+		t.Fatal(err)
+	}
+	if file, _ := ioutil.ReadFile(hostsPath); string(file) != original {
+		t.Errorf("dry run wrote %q", file)
+	}
+	if err := hosts.save(false); err != nil {
+		t.Fatal(err)
+	}
+	hosts.removeManagedHost("managedvpn.local")
+	if err := hosts.save(false); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := ioutil.ReadFile(hostsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(original, "198.51.100.1 wiki managedvpn.local", "198.51.100.1\twiki", 1)
+	if string(file) != want {
+		t.Errorf("hosts file = %q, want %q", file, want)
+	}
+}
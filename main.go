@@ -16,26 +16,89 @@ import (
 )
 
 var (
+	//Global Flags
+	resourcePathFlag = kingpin.Flag("resource-path", "Directory holding hosts, profiles and config.").Envar("VPN_RESOURCE_PATH").String()
+	configFileFlag   = kingpin.Flag("config-file", "Config file, defaults to config.yaml in the resource path.").Envar("VPN_CONFIG_FILE").String()
+	configOverrides  = kingpin.Flag("set", "Override a config setting, e.g. --set connect_timeout=20s.").StringMap()
+	backendName      = kingpin.Flag("backend", "VPN backend driver, overrides config file.").String()
 	//Connection Commands
-	connect = kingpin.Command("connect", "Connect to a VPN")
-	profile = connect.Flag("profile", "profile name.").Required().Short('p').Envar("VPN_PROFILE").String()
-	vpn     = connect.Arg("vpn", "Identifier for VPN to be connected").Required().String()
+	connect           = kingpin.Command("connect", "Connect to a VPN")
+	profile           = connect.Flag("profile", "profile name, overrides the host_profiles mapping.").Short('p').Envar("VPN_PROFILE").String()
+	vpn               = connect.Arg("vpn", "Identifier for VPN to be connected, defaults to the profile's default host").String()
+	connectKeepRoutes = connect.Flag("keep-routes", "Leave routes to a previously connected host in place.").Bool()
+	keepExisting      = connect.Flag("keep-existing", "Connect alongside existing connections instead of replacing them.").Bool()
+	connectDryRun     = connect.Flag("dry-run", "Show the hosts file change for the host and exit without connecting.").Bool()
+	connectIPv6       = connect.Flag("ipv6", "Also route the VPC's IPv6 CIDR blocks.").Bool()
+	connectAWSProfile = connect.Flag("aws-profile", "Only match hosts discovered with this AWS profile.").String()
+	connectRegion     = connect.Flag("region", "Only match hosts discovered in this AWS region.").String()
+	connectWatch      = connect.Flag("watch", "Stay running and reconnect when the connection drops.").Bool()
+	//Watch Commands
+	watch     = kingpin.Command("watch", "Reconnect managed VPN connections when they drop")
+	watchHost = watch.Arg("host", "Name, instance ID or VPC ID of the host to watch, or a connection name, defaults to every connection").String()
 	//Disconnect Commands
-	_ = kingpin.Command("disconnect", "Disconnect current VPN connection")
+	disconnect           = kingpin.Command("disconnect", "Disconnect current VPN connection")
+	disconnectHost       = disconnect.Arg("host", "Name, instance ID or VPC ID of the host to disconnect, or a connection name").String()
+	disconnectAll        = disconnect.Flag("all", "Disconnect every managed VPN connection.").Bool()
+	disconnectKeepRoutes = disconnect.Flag("keep-routes", "Leave routes added for the connection in place.").Bool()
+	//Status Commands
+	statusCmd    = kingpin.Command("status", "Show the state of the managed VPN connection")
+	statusOutput = statusCmd.Flag("output", "Output format.").Short('o').Default("table").Enum("table", "json")
 	//Host Commands
-	hosts = kingpin.Command("host", "Commands related to vpn hosts")
-	_     = hosts.Command("list", "List vpn hosts")
-	_     = hosts.Command("refresh", "Refreshes resources")
+	hosts           = kingpin.Command("host", "Commands related to vpn hosts")
+	_               = hosts.Command("list", "List vpn hosts")
+	refreshHostsCmd = hosts.Command("refresh", "Refreshes resources")
+	discoverRegions = refreshHostsCmd.Flag("discover-regions", "Rediscover enabled AWS regions instead of using the cached list.").Bool()
+	refreshProfiles = refreshHostsCmd.Flag("aws-profile", "Only refresh hosts for this AWS profile, may be repeated.").Strings()
 	//Profile Commands
-	profiles      = kingpin.Command("profile", "Commands related to VPN connection profiles")
-	_             = profiles.Command("list", "List vpn connection profiles")
-	addProfilecmd = profiles.Command("add", "Add new profile to existing set")
-	newProfile    = addProfilecmd.Arg("profile", "Name of profile to add").Required().String()
+	profiles           = kingpin.Command("profile", "Commands related to VPN connection profiles")
+	_                  = profiles.Command("list", "List vpn connection profiles")
+	addProfilecmd      = profiles.Command("add", "Add new profile to existing set")
+	newProfile         = addProfilecmd.Arg("profile", "Name of profile to add").Required().String()
+	addProfileUser     = addProfilecmd.Flag("username", "Username, skips the interactive prompts.").String()
+	addProfilePWStdin  = addProfilecmd.Flag("password-stdin", "Read the password from the first line of stdin.").Bool()
+	addProfilePSKFile  = addProfilecmd.Flag("psk-file", "Read the PSK from a file.").String()
+	addProfileFromJSON = addProfilecmd.Flag("from-json", "Read profile fields from a JSON file, - for stdin.").String()
+	removeProfilecmd   = profiles.Command("remove", "Remove a profile")
+	removeProfileName  = removeProfilecmd.Arg("profile", "Name of profile to remove").Required().String()
+	removeProfileYes   = removeProfilecmd.Flag("yes", "Skip confirmation.").Short('y').Bool()
+	renameProfilecmd   = profiles.Command("rename", "Rename a profile")
+	renameProfileName  = renameProfilecmd.Arg("profile", "Name of profile to rename").Required().String()
+	renameProfileNew   = renameProfilecmd.Arg("new-name", "New name for the profile").Required().String()
+	renameProfileYes   = renameProfilecmd.Flag("yes", "Skip confirmation.").Short('y').Bool()
+	editProfilecmd     = profiles.Command("edit", "Update fields of a profile, prompts for each field when no field flags are given")
+	editProfileName    = editProfilecmd.Arg("profile", "Name of profile to edit").Required().String()
+	editProfileUser    = editProfilecmd.Flag("username", "New username.").String()
+	editProfilePWStdin = editProfilecmd.Flag("password-stdin", "Read the new password from the first line of stdin.").Bool()
+	editProfilePSK     = editProfilecmd.Flag("psk-stdin", "Read the new PSK from the next line of stdin.").Bool()
+	editProfileOTPMode = editProfilecmd.Flag("otp-mode", "New OTP mode.").Enum("none", otpModeAppend, otpModeSubstitute)
+	editProfileYes     = editProfilecmd.Flag("yes", "Skip confirmation.").Short('y').Bool()
+	exportProfilecmd   = profiles.Command("export", "Export a profile to a passphrase encrypted bundle")
+	exportProfileName  = exportProfilecmd.Arg("profile", "Name of profile to export").Required().String()
+	exportOutput       = exportProfilecmd.Flag("output", "Bundle file to write, defaults to <profile>.vpnprofile.").Short('o').String()
+	exportAWSProfile   = exportProfilecmd.Flag("aws-profile", "Include the host discovery filters for this AWS profile.").String()
+	exportDefaultHost  = exportProfilecmd.Flag("default-host", "Host the profile connects to when none is given.").String()
+	exportReferences   = exportProfilecmd.Flag("keep-references", "Export secret references instead of resolving them, they only resolve where the same secrets exist.").Bool()
+	importProfilecmd   = profiles.Command("import", "Import a profile from an exported bundle")
+	importBundle       = importProfilecmd.Arg("file", "Bundle file to import").Required().ExistingFile()
+	importName         = importProfilecmd.Flag("name", "Import the profile under a different name.").String()
+	importPolicy       = importProfilecmd.Flag("policy", "What to do when a profile or host filter with the same name exists.").Default(bundlePolicyFail).Enum(bundlePolicyFail, bundlePolicyMerge, bundlePolicyReplace)
+	importReferences   = importProfilecmd.Flag("allow-references", "Import secret references, exec references run their command when connecting.").Bool()
+	//Config Commands
+	configs      = kingpin.Command("config", "Commands related to vpn configuration")
+	_            = configs.Command("show", "Show the effective configuration")
+	getConfigCmd = configs.Command("get", "Show a configuration value")
+	getConfigKey = getConfigCmd.Arg("key", "Dotted config key, e.g. strongswan.config_dir").Required().String()
+	setConfigCmd = configs.Command("set", "Set a configuration value in the config file")
+	setConfigKey = setConfigCmd.Arg("key", "Dotted config key, e.g. strongswan.config_dir").Required().String()
+	setConfigArg = setConfigCmd.Arg("value", "Value, parsed as YAML").Required().String()
 	//Command Regex Section
 	connectRegex           = regexp.MustCompile(`^connect`)
 	hostCommadRegex        = regexp.MustCompile(`^host`)
 	profileCommandRegex    = regexp.MustCompile(`^profile`)
 	disconnectCommandRegex = regexp.MustCompile(`^disconnect`)
+	statusCommandRegex     = regexp.MustCompile(`^status`)
+	configCommandRegex     = regexp.MustCompile(`^config`)
+	watchCommandRegex      = regexp.MustCompile(`^watch`)
 	//Global Vars
 	cliVersion   = "1.0.0"
 	resourcePath = path.Join(os.Getenv("HOME"), ".vpn_host_manager")
@@ -61,7 +124,7 @@ func hostFunctions(hostMethod string) {
 	case "host list":
 		listVpnHosts()
 	case "host refresh":
-		refreshHosts()
+		refreshHosts(*discoverRegions, *refreshProfiles)
 	}
 }
 
@@ -70,20 +133,79 @@ func profileFunctions(profileMethod string) {
 	case "profile list":
 		printVPNProfileList()
 	case "profile add":
-		addProfile(*newProfile)
+		addProfile(*newProfile, profileInput{
+			userName:      *addProfileUser,
+			passwordStdin: *addProfilePWStdin,
+			pskFile:       *addProfilePSKFile,
+			fromJSON:      *addProfileFromJSON,
+		})
+	case "profile remove":
+		removeProfile(*removeProfileName, *removeProfileYes)
+	case "profile rename":
+		renameProfile(*renameProfileName, *renameProfileNew, *renameProfileYes)
+	case "profile edit":
+		editProfile(*editProfileName, profileUpdate{
+			userName:      *editProfileUser,
+			passwordStdin: *editProfilePWStdin,
+			pskStdin:      *editProfilePSK,
+			otpMode:       *editProfileOTPMode,
+		}, *editProfileYes)
+	case "profile export":
+		exportProfile(*exportProfileName, bundleExport{
+			output:         *exportOutput,
+			awsProfile:     *exportAWSProfile,
+			defaultHost:    *exportDefaultHost,
+			keepReferences: *exportReferences,
+		})
+	case "profile import":
+		importProfile(*importBundle, bundleImport{
+			newName:         *importName,
+			policy:          *importPolicy,
+			allowReferences: *importReferences,
+		})
 	default:
 		log.Fatalf("not sure what to do with command: %s", profileMethod)
 	}
 
 }
 
-func connectVPN(profileName string, vpnIdentifier string) {
-	startConnection(vpnIdentifier, profileName)
+func connectVPN(profileName string, vpnIdentifier string, options connectOptions) {
+	if vpnIdentifier == "" {
+		if profileName == "" {
+			log.Fatal("Provide a VPN identifier, or a profile with a default host")
+		}
+		vpnIdentifier = defaultHostForProfile(profileName)
+	}
+	startConnection(vpnIdentifier, profileName, options)
 }
 
-func disconnectVPN() {
+func disconnectVPN(identifier string, all bool, keepRoutes bool) {
 	fmt.Println("😭  BYE!! 😭")
-	disconnectConnection()
+	disconnectConnections(identifier, all, keepRoutes)
+}
+
+func configFunctions(configMethod string) {
+	switch configMethod {
+	case "config show":
+		showConfig()
+	case "config get":
+		getConfigValue(*getConfigKey)
+	case "config set":
+		setConfigCommand(*setConfigKey, *setConfigArg)
+	default:
+		log.Fatalf("not sure what to do with command: %s", configMethod)
+	}
+}
+
+// setResourcePath moves every resource file into dir
+func setResourcePath(dir string) {
+	resourcePath = dir
+	configFilePath = path.Join(dir, path.Base(configFilePath))
+	hostFilePath = path.Join(dir, path.Base(hostFilePath))
+	vpnProfileFilePath = path.Join(dir, path.Base(vpnProfileFilePath))
+	awsProfileNamesPath = path.Join(dir, path.Base(awsProfileNamesPath))
+	awsRegionCachePath = path.Join(dir, path.Base(awsRegionCachePath))
+	sessionFilePath = path.Join(dir, path.Base(sessionFilePath))
 }
 
 func setupDirectories() {
@@ -95,24 +217,60 @@ func setupDirectories() {
 	}
 }
 
+func setupConfig() {
+	if *configFileFlag != "" {
+		configFilePath = *configFileFlag
+	}
+	config = loadConfigFile()
+	if *backendName != "" {
+		(*configOverrides)["backend"] = *backendName
+	}
+	applyConfigOverrides(&config, *configOverrides)
+	applyConfig()
+}
+
+func setupBackend() {
+	//fail on an unknown backend before any command runs
+	selectBackend(config.Backend, managedSlot(0))
+}
+
 func setup() {
 	permissionCheck()
+	if *resourcePathFlag != "" {
+		setResourcePath(*resourcePathFlag)
+	}
 	setupDirectories()
+	setupConfig()
+	setupBackend()
 }
 
 func main() {
 	kingpin.Version(cliVersion)
-	setup()
 	parsedArg := kingpin.Parse()
+	setup()
 	switch {
 	case hostCommadRegex.MatchString(parsedArg):
 		hostFunctions(parsedArg)
 	case profileCommandRegex.MatchString(parsedArg):
 		profileFunctions(parsedArg)
 	case connectRegex.MatchString(parsedArg):
-		connectVPN(*profile, *vpn)
+		connectVPN(*profile, *vpn, connectOptions{
+			keepRoutes:   *connectKeepRoutes,
+			keepExisting: *keepExisting,
+			dryRun:       *connectDryRun,
+			ipv6:         *connectIPv6,
+			awsProfile:   *connectAWSProfile,
+			region:       *connectRegion,
+			watch:        *connectWatch,
+		})
 	case disconnectCommandRegex.MatchString(parsedArg):
-		disconnectVPN()
+		disconnectVPN(*disconnectHost, *disconnectAll, *disconnectKeepRoutes)
+	case watchCommandRegex.MatchString(parsedArg):
+		watchConnections(*watchHost)
+	case configCommandRegex.MatchString(parsedArg):
+		configFunctions(parsedArg)
+	case statusCommandRegex.MatchString(parsedArg):
+		printConnectionStatus(*statusOutput)
 	default:
 		//if we are in this error block it is because we have established
 		//a command for the provided text, but have not specified a regex
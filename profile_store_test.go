@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestEncryptingProfileStoreRemovesPlaintextBackup(t *testing.T) {
+	useTestResources(t)
+	config.ProfileStore.Encrypt = true
+	savedPassphrase := profileStorePassphrase
+	profileStorePassphrase = []byte("test passphrase")
+	t.Cleanup(func() { profileStorePassphrase = savedPassphrase })
+	//a bare list, as written before resource files were versioned
+	err := ioutil.WriteFile(vpnProfileFilePath, []byte(`[{"name":"test","psk":"secret","username":"alice","password":"hunter2"}]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profiles := loadProfileFile()
+
+	if want := []vpnProfile{testProfile}; !reflect.DeepEqual(profiles, want) {
+		t.Errorf("profiles = %+v, want %+v", profiles, want)
+	}
+	backup := vpnProfileFilePath + ".v0.bak"
+	if _, err := os.Stat(backup); !os.IsNotExist(err) {
+		t.Errorf("plaintext backup %s was kept: %v", backup, err)
+	}
+	file, err := ioutil.ReadFile(vpnProfileFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(file, []byte("hunter2")) || isPlaintextProfileStore(decodeResourceFile(vpnProfileFilePath, file).Data) {
+		t.Errorf("%s was not encrypted: %s", vpnProfileFilePath, file)
+	}
+	if profiles := loadProfileFile(); !reflect.DeepEqual(profiles, []vpnProfile{testProfile}) {
+		t.Errorf("encrypted profiles = %+v", profiles)
+	}
+}
+
+func TestPlaintextProfileStoreKeepsBackup(t *testing.T) {
+	useTestResources(t)
+	err := ioutil.WriteFile(vpnProfileFilePath, []byte(`[{"name":"test","psk":"secret","username":"alice","password":"hunter2"}]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadProfileFile()
+
+	//with encryption off the profile file is plaintext too, the backup
+	//exposes nothing more
+	info, err := os.Stat(vpnProfileFilePath + ".v0.bak")
+	if err != nil {
+		t.Fatalf("backup missing: %s", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("backup mode = %o, want 600", info.Mode().Perm())
+	}
+}
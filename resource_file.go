@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+)
+
+// resourceFileVersion is the schema version written to vpn_hosts.json,
+// vpn_profiles.json and aws_profile_names.json
+const resourceFileVersion = 1
+
+// resourceFile is the versioned envelope around the data of a resource file,
+// files written before versioning hold the bare data and are version 0
+type resourceFile struct {
+	Version int             `json:"version"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// resourceMigration upgrades the data of a resource file by one version
+type resourceMigration func(data json.RawMessage) (json.RawMessage, error)
+
+// resourceMigrations lists the migrations for each resource file by file
+// name, the migration at index i upgrades version i to version i+1
+var resourceMigrations = map[string][]resourceMigration{
+	"vpn_hosts.json":         {wrapBareList},
+	"vpn_profiles.json":      {wrapBareList},
+	"aws_profile_names.json": {wrapBareList},
+}
+
+// resourceFileModes are the permissions each resource file is written with,
+// files holding secrets are only readable by their owner
+var resourceFileModes = map[string]os.FileMode{
+	"vpn_hosts.json":         0644,
+	"vpn_profiles.json":      0600,
+	"aws_profile_names.json": 0644,
+}
+
+// wrapBareList upgrades version 0 files, the bare list is kept unchanged as
+// the data of the envelope
+func wrapBareList(data json.RawMessage) (json.RawMessage, error) {
+	return data, nil
+}
+
+func decodeResourceFile(filePath string, file []byte) resourceFile {
+	trimmed := bytes.TrimSpace(file)
+	if !bytes.HasPrefix(trimmed, []byte("{")) || isSealedProfileStore(trimmed) {
+		return resourceFile{Version: 0, Data: trimmed}
+	}
+	var envelope resourceFile
+	err := json.Unmarshal(trimmed, &envelope)
+	if err != nil || envelope.Data == nil {
+		log.Fatalf("Could not read %s, unrecognised file format", filePath)
+	}
+	return envelope
+}
+
+// isSealedProfileStore reports whether file is an encrypted profile store
+// written before resource files were versioned
+func isSealedProfileStore(file []byte) bool {
+	var box sealedBox
+	return json.Unmarshal(file, &box) == nil && box.Cipher != ""
+}
+
+// readResourceFile returns the data of a resource file, files written by an
+// older version are migrated and rewritten after a backup is taken
+func readResourceFile(filePath string) ([]byte, error) {
+	file, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	envelope := decodeResourceFile(filePath, file)
+	if envelope.Version >= resourceFileVersion {
+		return envelope.Data, nil
+	}
+	unlock := lockResources()
+	defer unlock()
+	//another process may have migrated the file while we waited for the lock
+	file, err = ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	envelope = decodeResourceFile(filePath, file)
+	if envelope.Version >= resourceFileVersion {
+		return envelope.Data, nil
+	}
+	migrations := resourceMigrations[path.Base(filePath)]
+	if len(migrations) < resourceFileVersion {
+		log.Fatalf("No migration for %s from version %d", filePath, envelope.Version)
+	}
+	data := envelope.Data
+	for version := envelope.Version; version < resourceFileVersion; version++ {
+		data, err = migrations[version](data)
+		if err != nil {
+			log.Fatalf("Could not migrate %s from version %d: %s", filePath, version, err)
+		}
+	}
+	backupPath := fmt.Sprintf("%s.v%d.bak", filePath, envelope.Version)
+	err = writeFileAtomic(backupPath, file, 0600)
+	if err != nil {
+		log.Fatalf("Could not back up %s before migrating it: %s", filePath, err)
+	}
+	fmt.Printf("Migrated %s to version %d, previous version saved to %s\n", filePath, resourceFileVersion, backupPath)
+	writeResourceFile(filePath, data)
+	return data, nil
+}
+
+// writeResourceFile wraps data in a versioned envelope and writes it,
+// files written by a newer version are never overwritten
+func writeResourceFile(filePath string, data []byte) {
+	unlock := lockResources()
+	defer unlock()
+	if file, err := ioutil.ReadFile(filePath); err == nil {
+		existing := decodeResourceFile(filePath, file)
+		if existing.Version > resourceFileVersion {
+			log.Fatalf("%s was written by a newer version (schema %d), refusing to overwrite it", filePath, existing.Version)
+		}
+	}
+	fileJSON, err := json.Marshal(resourceFile{Version: resourceFileVersion, Data: data})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = writeFileAtomic(filePath, fileJSON, resourceFileModes[path.Base(filePath)])
+	if err != nil {
+		log.Fatalf("Could not write %s: %s", filePath, err)
+	}
+}
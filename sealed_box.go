@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+	"io"
+	"os"
+)
+
+const (
+	sealedBoxCipher = "nacl-secretbox"
+	sealedBoxKDF    = "scrypt"
+	scryptN         = 32768
+	scryptR         = 8
+	scryptP         = 1
+)
+
+var errSealedBoxOpen = errors.New("could not decrypt, wrong passphrase or corrupted data")
+
+// sealedBox is data encrypted with NaCl secretbox under a key derived from
+// a passphrase with scrypt
+type sealedBox struct {
+	Cipher string `json:"cipher"`
+	KDF    string `json:"kdf"`
+	Salt   []byte `json:"salt"`
+	Nonce  []byte `json:"nonce"`
+	Data   []byte `json:"data"`
+}
+
+func deriveKey(passphrase []byte, salt []byte) (*[32]byte, error) {
+	derived, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	copy(key[:], derived)
+	return &key, nil
+}
+
+func sealWithPassphrase(plaintext []byte, passphrase []byte) (sealedBox, error) {
+	box := sealedBox{
+		Cipher: sealedBoxCipher,
+		KDF:    sealedBoxKDF,
+		Salt:   make([]byte, 16),
+		Nonce:  make([]byte, 24),
+	}
+	if _, err := io.ReadFull(rand.Reader, box.Salt); err != nil {
+		return box, err
+	}
+	if _, err := io.ReadFull(rand.Reader, box.Nonce); err != nil {
+		return box, err
+	}
+	key, err := deriveKey(passphrase, box.Salt)
+	if err != nil {
+		return box, err
+	}
+	var nonce [24]byte
+	copy(nonce[:], box.Nonce)
+	box.Data = secretbox.Seal(nil, plaintext, &nonce, key)
+	return box, nil
+}
+
+func openWithPassphrase(box sealedBox, passphrase []byte) ([]byte, error) {
+	if box.Cipher != sealedBoxCipher || box.KDF != sealedBoxKDF {
+		return nil, fmt.Errorf("unsupported encryption %s/%s", box.Cipher, box.KDF)
+	}
+	if len(box.Nonce) != 24 {
+		return nil, errSealedBoxOpen
+	}
+	key, err := deriveKey(passphrase, box.Salt)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	copy(nonce[:], box.Nonce)
+	plaintext, ok := secretbox.Open(nil, box.Data, &nonce, key)
+	if !ok {
+		return nil, errSealedBoxOpen
+	}
+	return plaintext, nil
+}
+
+// capturePassphrase prompts for a passphrase without echoing it, confirm
+// asks for it twice when a new passphrase is being chosen
+func capturePassphrase(prompt string, confirm bool) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, errors.New("a passphrase is required but stdin is not a terminal")
+	}
+	fmt.Printf("%s ", prompt)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("passphrase can not be empty")
+	}
+	if confirm {
+		fmt.Print("Confirm passphrase: ")
+		confirmation, err := term.ReadPassword(fd)
+		fmt.Println()
+		if err != nil {
+			return nil, err
+		}
+		if string(confirmation) != string(passphrase) {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
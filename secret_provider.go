@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// secretProvider resolves the reference of a secret reference such as
+// `secret://env:VPN_PSK` to the secret it points at
+type secretProvider interface {
+	Resolve(reference string) (string, error)
+}
+
+var secretProviders = map[string]secretProvider{
+	"env":     envSecretProvider{},
+	"file":    fileSecretProvider{},
+	"exec":    execSecretProvider{},
+	"keyring": keyringSecretProvider{},
+}
+
+// envSecretProvider reads `secret://env:VAR`
+type envSecretProvider struct{}
+
+func (p envSecretProvider) Resolve(reference string) (string, error) {
+	secret, ok := os.LookupEnv(reference)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", reference)
+	}
+	return secret, nil
+}
+
+// fileSecretProvider reads `secret://file:/path/to/secret`
+type fileSecretProvider struct{}
+
+func (p fileSecretProvider) Resolve(reference string) (string, error) {
+	secret, err := ioutil.ReadFile(reference)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(secret), "\r\n"), nil
+}
+
+// execSecretProvider runs `secret://exec:command args` and uses its stdout
+type execSecretProvider struct{}
+
+func (p execSecretProvider) Resolve(reference string) (string, error) {
+	args := strings.Fields(reference)
+	if len(args) == 0 {
+		return "", fmt.Errorf("no command given")
+	}
+	output, err := runner.Output(args[0], args[1:]...)
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %s", args[0], err)
+	}
+	return strings.TrimRight(string(output), "\r\n"), nil
+}
+
+// keyringSecretProvider reads `secret://keyring:service/account` from the OSX
+// keychain or the Secret Service on Linux
+type keyringSecretProvider struct{}
+
+func (p keyringSecretProvider) Resolve(reference string) (string, error) {
+	parts := strings.SplitN(reference, "/", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("keyring references take the form secret://keyring:service/account")
+	}
+	var output []byte
+	var err error
+	if runtime.GOOS == "darwin" {
+		output, err = runner.Output("security", "find-generic-password", "-s", parts[0], "-a", parts[1], "-w")
+	} else {
+		output, err = runner.Output("secret-tool", "lookup", "service", parts[0], "account", parts[1])
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not read %s from keyring: %s", reference, err)
+	}
+	return strings.TrimRight(string(output), "\r\n"), nil
+}
+
+// secretReferencePrefix marks a profile value as a secret reference, values
+// without it are always used as they are
+const secretReferencePrefix = "secret://"
+
+// isSecretReference reports whether value references a secret
+func isSecretReference(value string) bool {
+	return strings.HasPrefix(value, secretReferencePrefix)
+}
+
+// looksLikeBareReference reports whether value has the `provider:reference`
+// form references had before they were marked with secretReferencePrefix
+func looksLikeBareReference(value string) bool {
+	parts := strings.SplitN(value, ":", 2)
+	_, ok := secretProviders[parts[0]]
+	return len(parts) == 2 && ok
+}
+
+// resolveSecret returns value unchanged unless it is a secret reference such
+// as `secret://env:VPN_PSK`, in which case the referenced secret is returned
+func resolveSecret(value string) (string, error) {
+	if !isSecretReference(value) {
+		return value, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, secretReferencePrefix), ":", 2)
+	provider, ok := secretProviders[parts[0]]
+	if len(parts) != 2 || !ok {
+		return "", fmt.Errorf("unknown secret reference %s, expected %s<provider>:<reference>", value, secretReferencePrefix)
+	}
+	return provider.Resolve(parts[1])
+}
+
+// profileSecretField is a profile value that may hold a secret reference
+type profileSecretField struct {
+	name  string
+	value *string
+}
+
+func profileSecretFields(vpnDetails *vpnProfile) []profileSecretField {
+	return []profileSecretField{
+		{"username", &vpnDetails.UserName},
+		{"password", &vpnDetails.PassWord},
+		{"psk", &vpnDetails.Psk},
+		{"totp seed", &vpnDetails.TOTPSeed},
+	}
+}
+
+// profileSecretReferences returns the names of the profile values that are
+// secret references
+func profileSecretReferences(vpnDetails vpnProfile) []string {
+	var names []string
+	for _, field := range profileSecretFields(&vpnDetails) {
+		if isSecretReference(*field.value) {
+			names = append(names, field.name)
+		}
+	}
+	return names
+}
+
+// resolveProfileSecrets returns a copy of vpnDetails with any secret
+// references replaced by the secrets themselves
+func resolveProfileSecrets(vpnDetails vpnProfile) (vpnProfile, error) {
+	for _, field := range profileSecretFields(&vpnDetails) {
+		if looksLikeBareReference(*field.value) {
+			fmt.Printf("Warning: the %s of profile %s is used as it is, prefix it with %s to resolve it as a secret reference\n", field.name, vpnDetails.Name, secretReferencePrefix)
+		}
+		resolved, err := resolveSecret(*field.value)
+		if err != nil {
+			return vpnDetails, fmt.Errorf("could not resolve %s for profile %s: %s", field.name, vpnDetails.Name, err)
+		}
+		*field.value = resolved
+	}
+	return vpnDetails, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	dir := useTestResources(t)
+	recorder := newRecordingRunner()
+	runner = recorder
+	recorder.On("op read op://vpn/prod/psk", "from-op\n", 0)
+	recorder.On("false", "", 1)
+	t.Setenv("VPN_TEST_PSK", "from-env")
+	pskFile := path.Join(dir, "psk")
+	err := ioutil.WriteFile(pskFile, []byte("from-file\r\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr string
+	}{
+		{name: "literal", value: "hunter2", want: "hunter2"},
+		{name: "literal with a colon", value: "pass:word", want: "pass:word"},
+		{name: "literal with a provider name", value: "exec:rm -rf /", want: "exec:rm -rf /"},
+		{name: "env", value: "secret://env:VPN_TEST_PSK", want: "from-env"},
+		{name: "env not set", value: "secret://env:VPN_TEST_UNSET", wantErr: "VPN_TEST_UNSET"},
+		{name: "file", value: "secret://file:" + pskFile, want: "from-file"},
+		{name: "file missing", value: "secret://file:" + path.Join(dir, "missing"), wantErr: "missing"},
+		{name: "exec", value: "secret://exec:op read op://vpn/prod/psk", want: "from-op"},
+		{name: "exec failing", value: "secret://exec:false", wantErr: "false failed"},
+		{name: "exec without a command", value: "secret://exec: ", wantErr: "no command given"},
+		{name: "unknown provider", value: "secret://vault:vpn/psk", wantErr: "unknown secret reference"},
+		{name: "no provider", value: "secret://VPN_TEST_PSK", wantErr: "unknown secret reference"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := resolveSecret(test.value)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("err = %v, want it to contain %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("resolveSecret(%q) = %q, want %q", test.value, got, test.want)
+			}
+		})
+	}
+	assertCalls(t, recorder, "", "op read op://vpn/prod/psk", "false")
+}
+
+func TestResolveProfileSecrets(t *testing.T) {
+	useTestResources(t)
+	t.Setenv("VPN_TEST_PSK", "from-env")
+	profile := vpnProfile{
+		Name:     "test",
+		Psk:      "secret://env:VPN_TEST_PSK",
+		UserName: "alice",
+		PassWord: "env:VPN_TEST_PSK",
+	}
+
+	resolved, err := resolveProfileSecrets(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Psk != "from-env" || resolved.UserName != "alice" || resolved.PassWord != "env:VPN_TEST_PSK" {
+		t.Errorf("resolved = %+v", resolved)
+	}
+	if profile.Psk != "secret://env:VPN_TEST_PSK" {
+		t.Errorf("the profile was modified: %+v", profile)
+	}
+
+	profile.TOTPSeed = "secret://env:VPN_TEST_UNSET"
+	_, err = resolveProfileSecrets(profile)
+	if err == nil || !strings.HasPrefix(err.Error(), "could not resolve totp seed for profile test: ") {
+		t.Errorf("err = %v, want it to name the field and profile", err)
+	}
+}
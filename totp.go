@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	otpModeAppend     = "append"
+	otpModeSubstitute = "substitute"
+	otpPlaceholder    = "{otp}"
+	totpStep          = 30 * time.Second
+	totpDigits        = 6
+)
+
+var otpModes = []string{otpModeAppend, otpModeSubstitute}
+
+// totpCode computes the RFC 6238 code for the base32 seed at time t
+func totpCode(seed string, t time.Time) (string, error) {
+	normalized := strings.ToUpper(strings.Replace(seed, " ", "", -1))
+	normalized = strings.TrimRight(normalized, "=")
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(normalized)
+	if err != nil {
+		return "", fmt.Errorf("invalid TOTP seed: %s", err)
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(t.Unix()/int64(totpStep.Seconds())))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	truncated := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, truncated%1000000), nil
+}
+
+func validOTPMode(mode string) bool {
+	if mode == "" {
+		return true
+	}
+	for _, known := range otpModes {
+		if mode == known {
+			return true
+		}
+	}
+	return false
+}
+
+// currentOTP returns the code for the profile, generated from its seed or
+// prompted for when no seed is stored
+func currentOTP(vpnDetails vpnProfile) string {
+	if vpnDetails.TOTPSeed == "" {
+		return detailCapture(fmt.Sprintf("One time password for profile %s:", vpnDetails.Name))
+	}
+	code, err := totpCode(vpnDetails.TOTPSeed, time.Now())
+	if err != nil {
+		log.Fatalf("Could not generate one time password for profile %s: %s", vpnDetails.Name, err)
+	}
+	return code
+}
+
+// applyOTP adds the current one time password to the profile's password
+// according to its OTP mode
+func applyOTP(vpnDetails vpnProfile) vpnProfile {
+	switch vpnDetails.OTPMode {
+	case otpModeAppend:
+		vpnDetails.PassWord = vpnDetails.PassWord + currentOTP(vpnDetails)
+	case otpModeSubstitute:
+		if strings.Contains(vpnDetails.PassWord, otpPlaceholder) {
+			vpnDetails.PassWord = strings.Replace(vpnDetails.PassWord, otpPlaceholder, currentOTP(vpnDetails), -1)
+		} else {
+			vpnDetails.PassWord = currentOTP(vpnDetails)
+		}
+	}
+	return vpnDetails
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Seed is the base32 encoding of the RFC 6238 SHA-1 test key
+// "12345678901234567890"
+const rfc6238Seed = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	//the RFC 6238 appendix B SHA-1 vectors, truncated to six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		got, err := totpCode(rfc6238Seed, time.Unix(test.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("totpCode at %d = %s, want %s", test.unix, got, test.want)
+		}
+	}
+}
+
+func TestTOTPCodeSeedFormats(t *testing.T) {
+	at := time.Unix(59, 0)
+	for _, seed := range []string{
+		"gezdgnbvgy3tqojqgezdgnbvgy3tqojq",
+		"GEZD GNBV GY3T QOJQ GEZD GNBV GY3T QOJQ",
+		rfc6238Seed + "====",
+	} {
+		got, err := totpCode(seed, at)
+		if err != nil {
+			t.Errorf("totpCode(%q) failed: %s", seed, err)
+			continue
+		}
+		if got != "287082" {
+			t.Errorf("totpCode(%q) = %s, want 287082", seed, got)
+		}
+	}
+	if _, err := totpCode("not base32!", at); err == nil {
+		t.Error("totpCode accepted an invalid seed")
+	}
+}
+
+func TestApplyOTP(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		password string
+		want     string
+	}{
+		{name: "no mode", password: "hunter2", want: "hunter2"},
+		{name: "append", mode: otpModeAppend, password: "hunter2", want: "hunter2123456"},
+		{name: "substitute placeholder", mode: otpModeSubstitute, password: "hunter2{otp}", want: "hunter2123456"},
+		{name: "substitute every placeholder", mode: otpModeSubstitute, password: "{otp}:hunter2:{otp}", want: "123456:hunter2:123456"},
+		{name: "substitute without placeholder", mode: otpModeSubstitute, password: "hunter2", want: "123456"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			//no seed is stored, the code is prompted for
+			pipeStdin(t, "123456\n")
+			profile := testProfile
+			profile.OTPMode = test.mode
+			profile.PassWord = test.password
+
+			got := applyOTP(profile)
+
+			if got.PassWord != test.want {
+				t.Errorf("password = %q, want %q", got.PassWord, test.want)
+			}
+			if profile.PassWord != test.password {
+				t.Errorf("the profile password was modified to %q", profile.PassWord)
+			}
+		})
+	}
+}
+
+func TestApplyOTPWithSeed(t *testing.T) {
+	profile := testProfile
+	profile.OTPMode = otpModeSubstitute
+	profile.PassWord = "hunter2{otp}"
+	profile.TOTPSeed = rfc6238Seed
+
+	before, _ := totpCode(rfc6238Seed, time.Now())
+	got := applyOTP(profile)
+	after, _ := totpCode(rfc6238Seed, time.Now())
+
+	//the step may have changed while applying it
+	if got.PassWord != "hunter2"+before && got.PassWord != "hunter2"+after {
+		t.Errorf("password = %q, want hunter2%s", got.PassWord, before)
+	}
+}
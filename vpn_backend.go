@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// VPNBackend wraps the platform tooling used to configure and drive the
+// managed L2TP/IPsec connection.
+type VPNBackend interface {
+	//Create installs the managed VPN configuration
+	Create() error
+	//Start brings the managed connection up with the provided credentials
+	Start(vpnDetails vpnProfile, vpnHost vpnInstance) error
+	//Stop tears down the managed connection
+	Stop() error
+	//Status reports the current state of the managed connection
+	Status() (connectionStatus, error)
+	//Show reports whether the managed VPN configuration exists
+	Show() bool
+	//AddRoute routes cidr through the managed connection's interface
+	AddRoute(cidr string) error
+	//DeleteRoute removes a route previously added with AddRoute
+	DeleteRoute(cidr string) error
+}
+
+var (
+	defaultBackend = platformBackend()
+	vpnBackends    = map[string]func(slot connectionSlot) VPNBackend{
+		"macos":      newMacOSBackend,
+		"strongswan": newStrongSwanBackend,
+	}
+)
+
+func platformBackend() string {
+	if runtime.GOOS == "linux" {
+		return "strongswan"
+	}
+	return "macos"
+}
+
+func backendNames() []string {
+	var names []string
+	for name := range vpnBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// selectBackend returns the named backend driving the connection in slot
+func selectBackend(name string, slot connectionSlot) VPNBackend {
+	newBackend, ok := vpnBackends[name]
+	if !ok {
+		log.Fatalf("Unknown VPN backend `%s`, available backends: %s", name, strings.Join(backendNames(), ", "))
+	}
+	return newBackend(slot)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// fakeNetwork is the state shared by the fakeBackends of every slot, keyed
+// by slot name
+type fakeNetwork struct {
+	configured map[string]bool
+	states     map[string]connectionState
+	endpoints  map[string]string
+	starts     map[string]int
+	routes     map[string][]string
+	//routes AddRoute fails for, as route does when they already exist
+	failRoutes map[string]bool
+	//called by Start once the connection is up
+	onStart func(slot connectionSlot, vpnDetails vpnProfile)
+}
+
+// fakeBackend is a VPNBackend that keeps its connections in a fakeNetwork
+type fakeBackend struct {
+	slot    connectionSlot
+	network *fakeNetwork
+}
+
+// useFakeBackend registers the fake backend and selects it for the length
+// of the test
+func useFakeBackend(t *testing.T) *fakeNetwork {
+	t.Helper()
+	network := &fakeNetwork{
+		configured: make(map[string]bool),
+		states:     make(map[string]connectionState),
+		endpoints:  make(map[string]string),
+		starts:     make(map[string]int),
+		routes:     make(map[string][]string),
+		failRoutes: make(map[string]bool),
+	}
+	vpnBackends["fake"] = func(slot connectionSlot) VPNBackend {
+		return fakeBackend{slot: slot, network: network}
+	}
+	savedBackend := config.Backend
+	config.Backend = "fake"
+	t.Cleanup(func() {
+		delete(vpnBackends, "fake")
+		config.Backend = savedBackend
+	})
+	return network
+}
+
+func (b fakeBackend) Create() error {
+	b.network.configured[b.slot.Name] = true
+	return nil
+}
+
+func (b fakeBackend) Start(vpnDetails vpnProfile, vpnHost vpnInstance) error {
+	if !b.network.configured[b.slot.Name] {
+		return fmt.Errorf("%s is not configured", b.slot.Name)
+	}
+	b.network.starts[b.slot.Name]++
+	b.network.states[b.slot.Name] = stateConnected
+	b.network.endpoints[b.slot.Name] = vpnEndpoint(b.slot, vpnHost)
+	if b.network.onStart != nil {
+		b.network.onStart(b.slot, vpnDetails)
+	}
+	return nil
+}
+
+func (b fakeBackend) Stop() error {
+	b.network.states[b.slot.Name] = stateDisconnected
+	return nil
+}
+
+func (b fakeBackend) Status() (connectionStatus, error) {
+	state, found := b.network.states[b.slot.Name]
+	if !found {
+		state = stateDisconnected
+	}
+	return connectionStatus{State: state, Interface: fmt.Sprintf("fake%d", b.slot.Index)}, nil
+}
+
+func (b fakeBackend) Show() bool {
+	return b.network.configured[b.slot.Name]
+}
+
+func (b fakeBackend) AddRoute(cidr string) error {
+	if b.network.failRoutes[cidr] {
+		return fmt.Errorf("route to %s: File exists", cidr)
+	}
+	b.network.routes[b.slot.Name] = append(b.network.routes[b.slot.Name], cidr)
+	return nil
+}
+
+func (b fakeBackend) DeleteRoute(cidr string) error {
+	var routes []string
+	for _, route := range b.network.routes[b.slot.Name] {
+		if route != cidr {
+			routes = append(routes, route)
+		}
+	}
+	b.network.routes[b.slot.Name] = routes
+	return nil
+}
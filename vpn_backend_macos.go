@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	managedPSK      = "osx_managed_psk"
+	managedUserName = "osx_managed_un"
+	managedPW       = "osx_managed_pw"
+	scutilStates    = map[string]connectionState{
+		"Connected":     stateConnected,
+		"Connecting":    stateConnecting,
+		"Disconnecting": stateDisconnecting,
+		"Disconnected":  stateDisconnected,
+	}
+	scutilInterfaceRegex   = regexp.MustCompile(`InterfaceName : (\S+)`)
+	scutilConnectTimeRegex = regexp.MustCompile(`ConnectTime : (\d+)`)
+	bootTimeRegex          = regexp.MustCompile(`sec = (\d+)`)
+)
+
+// macOSBackend manages the connection through macosvpn and scutil
+type macOSBackend struct {
+	slot connectionSlot
+}
+
+func newMacOSBackend(slot connectionSlot) VPNBackend {
+	return macOSBackend{slot: slot}
+}
+
+func macvpnArgs(name string, endpoint string) []string {
+	args := []string{"create",
+		"--l2tp",
+		name,
+		"--endpoint",
+		endpoint,
+		"--username",
+		managedUserName,
+		"--password",
+		managedPW,
+		"--shared-secret",
+		managedPSK,
+	}
+	if config.MacOS.SplitTunnel {
+		args = append(args, "--split")
+	}
+	return append(args, "--force")
+}
+
+func (b macOSBackend) Create() error {
+	return runner.Run(config.MacOS.Command, macvpnArgs(b.slot.Name, b.slot.Host)...)
+}
+
+func (b macOSBackend) Start(vpnDetails vpnProfile, vpnHost vpnInstance) error {
+	if config.EndpointMode == endpointModeDirect {
+		//macosvpn --force replaces the connection with one using the new endpoint
+		err := runner.Run(config.MacOS.Command, macvpnArgs(b.slot.Name, vpnHost.PublicIP)...)
+		if err != nil {
+			return fmt.Errorf("could not point managed VPN at %s: %s", vpnHost.PublicIP, err)
+		}
+	}
+	err := runner.Run("scutil",
+		"--nc",
+		"start",
+		b.slot.Name,
+		"--user",
+		vpnDetails.UserName,
+		"--password",
+		vpnDetails.PassWord,
+		"--secret",
+		vpnDetails.Psk)
+	if err != nil {
+		return fmt.Errorf("could not connect to vpn via scutil: %s", err)
+	}
+	return nil
+}
+
+func (b macOSBackend) Stop() error {
+	return runner.Run("scutil", "--nc", "stop", b.slot.Name)
+}
+
+func (b macOSBackend) Status() (connectionStatus, error) {
+	var status connectionStatus
+	output, err := runner.Output("scutil", "--nc", "status", b.slot.Name)
+	if err != nil {
+		return status, err
+	}
+	firstLine := strings.TrimSpace(strings.SplitN(string(output), "\n", 2)[0])
+	state, ok := scutilStates[firstLine]
+	if !ok {
+		return status, fmt.Errorf("unexpected status for %s: %s", b.slot.Name, firstLine)
+	}
+	status.State = state
+	if state == stateDisconnected {
+		return status, nil
+	}
+	if match := scutilInterfaceRegex.FindSubmatch(output); match != nil {
+		status.Interface = string(match[1])
+	}
+	if match := scutilConnectTimeRegex.FindSubmatch(output); match != nil {
+		//ConnectTime is reported in seconds since boot
+		seconds, _ := strconv.ParseInt(string(match[1]), 10, 64)
+		if bootTime, err := macOSBootTime(); err == nil {
+			status.ConnectedAt = bootTime.Add(time.Duration(seconds) * time.Second)
+		}
+	}
+	if status.Interface != "" {
+		status.Routes, _ = macOSInterfaceRoutes(status.Interface)
+	}
+	return status, nil
+}
+
+func (b macOSBackend) Show() bool {
+	err := runner.Run("scutil", "--nc", "show", b.slot.Name)
+	if err != nil {
+		return false
+	}
+	return true
+}
+
+func (b macOSBackend) AddRoute(cidr string) error {
+	return runner.Run("route", macOSRouteArgs("add", cidr, b.interfaceName())...)
+}
+
+func (b macOSBackend) DeleteRoute(cidr string) error {
+	return runner.Run("route", macOSRouteArgs("delete", cidr, b.interfaceName())...)
+}
+
+// interfaceName returns the ppp interface scutil reports for the slot, each
+// connection up at the same time gets its own
+func (b macOSBackend) interfaceName() string {
+	if status, err := b.Status(); err == nil && status.Interface != "" {
+		return status.Interface
+	}
+	return "ppp0"
+}
+
+func macOSRouteArgs(action string, cidr string, iface string) []string {
+	if strings.Contains(cidr, ":") {
+		return []string{"-v", action, "-inet6", "-net", cidr, "-interface", iface}
+	}
+	return []string{"-v", action, "-net", cidr, "-interface", iface}
+}
+
+func macOSBootTime() (time.Time, error) {
+	output, err := runner.Output("sysctl", "-n", "kern.boottime")
+	if err != nil {
+		return time.Time{}, err
+	}
+	match := bootTimeRegex.FindSubmatch(output)
+	if match == nil {
+		return time.Time{}, fmt.Errorf("could not parse boot time: %s", output)
+	}
+	seconds, err := strconv.ParseInt(string(match[1]), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+// macOSInterfaceRoutes lists the IPv4 routing table destinations sent
+// through iface
+func macOSInterfaceRoutes(iface string) ([]string, error) {
+	output, err := runner.Output("netstat", "-rn", "-f", "inet")
+	if err != nil {
+		return nil, err
+	}
+	var routes []string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 4 && fields[3] == iface {
+			routes = append(routes, fields[0])
+		}
+	}
+	return routes, nil
+}
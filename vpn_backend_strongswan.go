@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// strongSwanMarker is on the first line of every file the strongswan
+// backend writes, files without it are never overwritten
+const strongSwanMarker = "generated by osx_vpn_manager"
+
+var (
+	ipsecInstalledRegex  = regexp.MustCompile(`INSTALLED`)
+	ipsecConnectingRegex = regexp.MustCompile(`CONNECTING|ESTABLISHED`)
+	pppOptionsNameRegex  = regexp.MustCompile(`(?m)^name "(.*)"$`)
+	pppUnitRegex         = regexp.MustCompile(`^ppp(\d+)$`)
+	//pppd reads backslash escapes inside quoted option values
+	pppEscaper              = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+	pppUnescaper            = strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\n`, "\n", `\r`, "\r")
+	strongSwanTemplateFuncs = template.FuncMap{
+		"base64":   func(value string) string { return base64.StdEncoding.EncodeToString([]byte(value)) },
+		"pppQuote": func(value string) string { return `"` + pppEscaper.Replace(value) + `"` },
+	}
+	ipsecConnTemplate = template.Must(template.New("conn").Parse(`# generated by osx_vpn_manager, changes will be overwritten
+conn {{.Name}}
+	auto=add
+	keyexchange=ikev1
+	authby=secret
+	type=transport
+	left=%defaultroute
+	leftprotoport=17/1701
+	right={{.Endpoint}}
+	rightprotoport=17/1701
+	ike=aes128-sha1-modp2048,aes256-sha1-modp1024,3des-sha1-modp1024!
+	esp=aes128-sha1,3des-sha1!
+`))
+	//the PSK is written base64 encoded (0s) so quotes and newlines in it can
+	//not end the secret early
+	ipsecConnSecretsTemplate = template.Must(template.New("conn.secrets").Funcs(strongSwanTemplateFuncs).Parse(`# generated by osx_vpn_manager, changes will be overwritten
+%any {{.Endpoint}} : PSK 0s{{base64 .Psk}}
+`))
+	xl2tpdConfTemplate = template.Must(template.New("xl2tpd.managed.conf").Parse(`; generated by osx_vpn_manager, changes will be overwritten
+{{range .Lacs}}[lac {{.Name}}]
+lns = {{.Endpoint}}
+ppp debug = no
+pppoptfile = {{.PPPOptionsFile}}
+length bit = yes
+
+{{end}}`))
+	pppOptionsTemplate = template.Must(template.New("options.l2tpd.client").Funcs(strongSwanTemplateFuncs).Parse(`# generated by osx_vpn_manager, changes will be overwritten
+ipcp-accept-local
+ipcp-accept-remote
+refuse-eap
+require-mschap-v2
+noccp
+noauth
+noipdefault
+nodefaultroute
+mtu 1280
+mru 1280
+connect-delay 5000
+{{if .Unit}}unit {{.Unit}}
+{{end}}name {{pppQuote .UserName}}
+password {{pppQuote .PassWord}}
+`))
+)
+
+// strongSwanBackend manages the connection in a slot through strongSwan for
+// the IPsec transport and xl2tpd for the L2TP tunnel running inside it.
+type strongSwanBackend struct {
+	slot        connectionSlot
+	configDir   string
+	controlFile string
+	iface       string
+}
+
+// strongSwanLac is an xl2tpd lac section, one is written for every slot
+type strongSwanLac struct {
+	Name           string
+	Endpoint       string
+	PPPOptionsFile string
+}
+
+type strongSwanTemplateData struct {
+	strongSwanLac
+	Psk      string
+	UserName string
+	PassWord string
+	Unit     string
+	Lacs     []strongSwanLac
+}
+
+// strongSwanInclude is a line added to a file shared with the rest of the
+// system, mode is only used when the file does not exist yet
+type strongSwanInclude struct {
+	path string
+	line string
+	mode os.FileMode
+}
+
+type strongSwanConfigFile struct {
+	path     string
+	mode     os.FileMode
+	template *template.Template
+}
+
+func newStrongSwanBackend(slot connectionSlot) VPNBackend {
+	return strongSwanBackend{
+		slot:        slot,
+		configDir:   config.StrongSwan.ConfigDir,
+		controlFile: config.StrongSwan.ControlFile,
+		iface:       strongSwanInterface(slot),
+	}
+}
+
+// strongSwanInterface is the configured interface for the first slot and
+// ppp<n> for the others, pppd is told to use it with the unit option
+func strongSwanInterface(slot connectionSlot) string {
+	if slot.Index == 0 {
+		return config.StrongSwan.Interface
+	}
+	return fmt.Sprintf("ppp%d", slot.Index)
+}
+
+func pppOptionsFile(configDir string, slot connectionSlot) string {
+	return filepath.Join(configDir, "ppp", "options.l2tpd."+slot.Name)
+}
+
+// strongSwanConfigFiles lists the files written for slot, every file is
+// owned by vpn. The lacs of every slot are written to a separate xl2tpd
+// config, the running xl2tpd is given them through its control file
+func strongSwanConfigFiles(configDir string, slot connectionSlot) []strongSwanConfigFile {
+	return []strongSwanConfigFile{
+		{filepath.Join(configDir, "xl2tpd", managedName+".conf"), 0644, xl2tpdConfTemplate},
+		{filepath.Join(configDir, "ipsec.d", slot.Name+".conf"), 0644, ipsecConnTemplate},
+		{filepath.Join(configDir, "ipsec.d", slot.Name+".secrets"), 0600, ipsecConnSecretsTemplate},
+		{pppOptionsFile(configDir, slot), 0600, pppOptionsTemplate},
+	}
+}
+
+// strongSwanIncludes are the include lines added to the system ipsec.conf
+// and ipsec.secrets so strongSwan reads the files of every slot
+func strongSwanIncludes(configDir string) []strongSwanInclude {
+	return []strongSwanInclude{
+		{filepath.Join(configDir, "ipsec.conf"), fmt.Sprintf("include %s/ipsec.d/%s*.conf", configDir, managedName), 0644},
+		{filepath.Join(configDir, "ipsec.secrets"), fmt.Sprintf("include %s/ipsec.d/%s*.secrets", configDir, managedName), 0600},
+	}
+}
+
+// hasInclude reports whether the file at filePath has the include line
+func hasInclude(filePath string, include string) (bool, error) {
+	file, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(file), "\n") {
+		if strings.TrimSpace(line) == include {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ensureInclude appends include to the file at filePath unless it is
+// already there, the rest of the file is left as it is
+func ensureInclude(filePath string, include string, perm os.FileMode) error {
+	found, err := hasInclude(filePath, include)
+	if err != nil || found {
+		return err
+	}
+	file, err := ioutil.ReadFile(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if info, err := os.Stat(filePath); err == nil {
+		perm = info.Mode().Perm()
+	}
+	content := string(file)
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	content += fmt.Sprintf("# added by osx_vpn_manager\n%s\n", include)
+	return writeFileAtomic(filePath, []byte(content), perm)
+}
+
+// checkOwnedFile refuses to overwrite a file vpn did not write
+func checkOwnedFile(filePath string) error {
+	file, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	firstLine := strings.SplitN(string(file), "\n", 2)[0]
+	if !strings.Contains(firstLine, strongSwanMarker) {
+		return fmt.Errorf("refusing to overwrite %s, it was not written by vpn", filePath)
+	}
+	return nil
+}
+
+// strongSwanLacEndpoint is the endpoint of the lac for a slot other than
+// the one being rendered, in direct mode the address the slot is connected
+// to rather than its host name
+func strongSwanLacEndpoint(slot connectionSlot) string {
+	if session, found := loadSessionFile(slot); found && config.EndpointMode == endpointModeDirect {
+		return session.PublicIP
+	}
+	return slot.Host
+}
+
+// renderStrongSwanConfig writes the ipsec and xl2tpd configuration for the
+// connection in slot into configDir
+func renderStrongSwanConfig(configDir string, slot connectionSlot, vpnDetails vpnProfile, endpoint string) error {
+	data := strongSwanTemplateData{
+		strongSwanLac: strongSwanLac{
+			Name:           slot.Name,
+			Endpoint:       endpoint,
+			PPPOptionsFile: pppOptionsFile(configDir, slot),
+		},
+		Psk:      vpnDetails.Psk,
+		UserName: vpnDetails.UserName,
+		PassWord: vpnDetails.PassWord,
+	}
+	if match := pppUnitRegex.FindStringSubmatch(strongSwanInterface(slot)); match != nil {
+		data.Unit = match[1]
+	}
+	for _, lacSlot := range managedSlots() {
+		if lacSlot.Index == slot.Index {
+			data.Lacs = append(data.Lacs, data.strongSwanLac)
+			continue
+		}
+		data.Lacs = append(data.Lacs, strongSwanLac{
+			Name:           lacSlot.Name,
+			Endpoint:       strongSwanLacEndpoint(lacSlot),
+			PPPOptionsFile: pppOptionsFile(configDir, lacSlot),
+		})
+	}
+	for _, file := range strongSwanConfigFiles(configDir, slot) {
+		err := os.MkdirAll(filepath.Dir(file.path), 0755)
+		if err != nil {
+			return err
+		}
+		err = checkOwnedFile(file.path)
+		if err != nil {
+			return err
+		}
+		var rendered strings.Builder
+		err = file.template.Execute(&rendered, data)
+		if err != nil {
+			return fmt.Errorf("could not render %s: %s", file.path, err)
+		}
+		err = writeFileAtomic(file.path, []byte(rendered.String()), file.mode)
+		if err != nil {
+			return fmt.Errorf("could not write %s: %s", file.path, err)
+		}
+	}
+	for _, include := range strongSwanIncludes(configDir) {
+		err := ensureInclude(include.path, include.line, include.mode)
+		if err != nil {
+			return fmt.Errorf("could not add include to %s: %s", include.path, err)
+		}
+	}
+	return nil
+}
+
+func (b strongSwanBackend) Create() error {
+	placeholder := vpnProfile{
+		Psk:      managedPSK,
+		UserName: managedUserName,
+		PassWord: managedPW,
+	}
+	return renderStrongSwanConfig(b.configDir, b.slot, placeholder, b.slot.Host)
+}
+
+func (b strongSwanBackend) Start(vpnDetails vpnProfile, vpnHost vpnInstance) error {
+	err := renderStrongSwanConfig(b.configDir, b.slot, vpnDetails, vpnEndpoint(b.slot, vpnHost))
+	if err != nil {
+		return err
+	}
+	for _, args := range [][]string{{"reload"}, {"rereadsecrets"}, {"up", b.slot.Name}} {
+		output, err := runner.CombinedOutput("ipsec", args...)
+		if err != nil {
+			return fmt.Errorf("ipsec %s failed: %s: %s", args[0], err, output)
+		}
+	}
+	//xl2tpd only reads its config file at startup, update the lac so the
+	//endpoint and options file apply without restarting it
+	err = b.control("a", "lns="+vpnEndpoint(b.slot, vpnHost), "pppoptfile="+pppOptionsFile(b.configDir, b.slot))
+	if err != nil {
+		return err
+	}
+	return b.control("c")
+}
+
+func (b strongSwanBackend) Stop() error {
+	err := b.control("d")
+	if err != nil {
+		return err
+	}
+	output, err := runner.CombinedOutput("ipsec", "down", b.slot.Name)
+	if err != nil {
+		return fmt.Errorf("ipsec down failed: %s: %s", err, output)
+	}
+	return nil
+}
+
+func (b strongSwanBackend) Status() (connectionStatus, error) {
+	var status connectionStatus
+	output, err := runner.Output("ipsec", "status", b.slot.Name)
+	if err != nil {
+		return status, err
+	}
+	_, ifaceErr := net.InterfaceByName(b.iface)
+	switch {
+	case ipsecInstalledRegex.Match(output) && ifaceErr == nil:
+		status.State = stateConnected
+	case ipsecInstalledRegex.Match(output), ipsecConnectingRegex.Match(output):
+		status.State = stateConnecting
+	default:
+		status.State = stateDisconnected
+		return status, nil
+	}
+	status.UserName = b.userName()
+	if status.State != stateConnected {
+		return status, nil
+	}
+	status.Interface = b.iface
+	//pppd writes its pid file once the link is up
+	if pidFile, err := os.Stat(filepath.Join("/var/run", b.iface+".pid")); err == nil {
+		status.ConnectedAt = pidFile.ModTime()
+	}
+	status.Routes, _ = b.interfaceRoutes()
+	return status, nil
+}
+
+func (b strongSwanBackend) Show() bool {
+	for _, file := range strongSwanConfigFiles(b.configDir, b.slot) {
+		if _, err := os.Stat(file.path); err != nil {
+			return false
+		}
+	}
+	for _, include := range strongSwanIncludes(b.configDir) {
+		if found, err := hasInclude(include.path, include.line); err != nil || !found {
+			return false
+		}
+	}
+	return true
+}
+
+// userName returns the user the ppp options file was last rendered with
+func (b strongSwanBackend) userName() string {
+	options, err := ioutil.ReadFile(pppOptionsFile(b.configDir, b.slot))
+	if err != nil {
+		return ""
+	}
+	if match := pppOptionsNameRegex.FindSubmatch(options); match != nil {
+		return pppUnescaper.Replace(string(match[1]))
+	}
+	return ""
+}
+
+func (b strongSwanBackend) interfaceRoutes() ([]string, error) {
+	output, err := runner.Output("ip", "route", "show", "dev", b.iface)
+	if err != nil {
+		return nil, err
+	}
+	var routes []string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			routes = append(routes, fields[0])
+		}
+	}
+	return routes, nil
+}
+
+func (b strongSwanBackend) AddRoute(cidr string) error {
+	return runner.Run("ip", b.routeArgs("add", cidr)...)
+}
+
+func (b strongSwanBackend) DeleteRoute(cidr string) error {
+	return runner.Run("ip", b.routeArgs("del", cidr)...)
+}
+
+func (b strongSwanBackend) routeArgs(action string, cidr string) []string {
+	if strings.Contains(cidr, ":") {
+		return []string{"-6", "route", action, cidr, "dev", b.iface}
+	}
+	return []string{"route", action, cidr, "dev", b.iface}
+}
+
+// control sends a command for the slot's lac to the running xl2tpd daemon,
+// params are passed as key=value pairs
+func (b strongSwanBackend) control(command string, params ...string) error {
+	controlFile, err := os.OpenFile(b.controlFile, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("could not open xl2tpd control file, is xl2tpd running? %s", err)
+	}
+	defer controlFile.Close()
+	line := fmt.Sprintf("%s %s", command, b.slot.Name)
+	if len(params) > 0 {
+		line += " " + strings.Join(params, ";")
+	}
+	_, err = fmt.Fprintln(controlFile, line)
+	return err
+}
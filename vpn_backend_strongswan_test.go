@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readRendered(t *testing.T, filePath string, mode os.FileMode) string {
+	t.Helper()
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != mode {
+		t.Errorf("%s mode = %o, want %o", filePath, info.Mode().Perm(), mode)
+	}
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestRenderStrongSwanConfig(t *testing.T) {
+	useTestResources(t)
+	config.MaxConnections = 2
+	configDir := t.TempDir()
+	slot := managedSlot(1)
+	details := vpnProfile{
+		Psk:      "pre\"shared\nkey",
+		UserName: `al"ice`,
+		PassWord: "hunter\"2\ninclude /etc/shadow\\",
+	}
+
+	err := renderStrongSwanConfig(configDir, slot, details, slot.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secrets := readRendered(t, filepath.Join(configDir, "ipsec.d", slot.Name+".secrets"), 0600)
+	wantSecret := "%any managedvpn-2.local : PSK 0s" + base64.StdEncoding.EncodeToString([]byte(details.Psk)) + "\n"
+	if !strings.HasSuffix(secrets, wantSecret) {
+		t.Errorf("secrets = %q, want it to end with %q", secrets, wantSecret)
+	}
+
+	options := readRendered(t, pppOptionsFile(configDir, slot), 0600)
+	for _, want := range []string{
+		"unit 1\n",
+		`name "al\"ice"` + "\n",
+		`password "hunter\"2\ninclude /etc/shadow\\"` + "\n",
+	} {
+		if !strings.Contains(options, want) {
+			t.Errorf("options = %q, want it to contain %q", options, want)
+		}
+	}
+	for _, line := range strings.Split(options, "\n") {
+		if strings.HasPrefix(line, "include") {
+			t.Errorf("password escaped its quotes, options has line %q", line)
+		}
+	}
+	backend := strongSwanBackend{slot: slot, configDir: configDir}
+	if got := backend.userName(); got != details.UserName {
+		t.Errorf("userName() = %q, want %q", got, details.UserName)
+	}
+
+	xl2tpd := readRendered(t, filepath.Join(configDir, "xl2tpd", managedName+".conf"), 0644)
+	for _, lacSlot := range managedSlots() {
+		want := "[lac " + lacSlot.Name + "]\nlns = " + lacSlot.Host + "\n"
+		if !strings.Contains(xl2tpd, want) {
+			t.Errorf("xl2tpd.conf = %q, want it to contain %q", xl2tpd, want)
+		}
+	}
+	systemSecrets := readRendered(t, filepath.Join(configDir, "ipsec.secrets"), 0600)
+	if !strings.Contains(systemSecrets, "include "+configDir+"/ipsec.d/osx_managed_vpn*.secrets\n") {
+		t.Errorf("ipsec.secrets = %q, want the include", systemSecrets)
+	}
+	conn := readRendered(t, filepath.Join(configDir, "ipsec.d", slot.Name+".conf"), 0644)
+	if !strings.Contains(conn, "conn "+slot.Name+"\n") || !strings.Contains(conn, "right="+slot.Host+"\n") {
+		t.Errorf("conn = %q", conn)
+	}
+}
+
+func TestRenderStrongSwanConfigDirectEndpoint(t *testing.T) {
+	useTestResources(t)
+	config.MaxConnections = 3
+	config.EndpointMode = endpointModeDirect
+	configDir := t.TempDir()
+	writeSessionFile(managedSlot(0), sessionFor(testHost("alpha", "203.0.113.10", "10.1.0.0/16")))
+	slot := managedSlot(1)
+
+	err := renderStrongSwanConfig(configDir, slot, testProfile, "203.0.113.20")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xl2tpd := readRendered(t, filepath.Join(configDir, "xl2tpd", managedName+".conf"), 0644)
+	for _, want := range []string{
+		"[lac osx_managed_vpn]\nlns = 203.0.113.10\n",
+		"[lac osx_managed_vpn_2]\nlns = 203.0.113.20\n",
+		//not connected, nothing to point it at yet
+		"[lac osx_managed_vpn_3]\nlns = managedvpn-3.local\n",
+	} {
+		if !strings.Contains(xl2tpd, want) {
+			t.Errorf("xl2tpd.conf = %q, want it to contain %q", xl2tpd, want)
+		}
+	}
+	conn := readRendered(t, filepath.Join(configDir, "ipsec.d", slot.Name+".conf"), 0644)
+	if !strings.Contains(conn, "right=203.0.113.20\n") {
+		t.Errorf("conn = %q, want right=203.0.113.20", conn)
+	}
+}
+
+func TestRenderStrongSwanConfigKeepsSystemFiles(t *testing.T) {
+	useTestResources(t)
+	configDir := t.TempDir()
+	systemConf := "config setup\n\nconn office\n\tright=198.51.100.1\n"
+	systemSecrets := "%any 198.51.100.1 : PSK \"office\""
+	err := ioutil.WriteFile(filepath.Join(configDir, "ipsec.conf"), []byte(systemConf), 0644)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(configDir, "ipsec.secrets"), []byte(systemSecrets), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot := managedSlot(0)
+	backend := strongSwanBackend{slot: slot, configDir: configDir}
+
+	for i := 0; i < 2; i++ {
+		err = renderStrongSwanConfig(configDir, slot, testProfile, slot.Host)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conf := readRendered(t, filepath.Join(configDir, "ipsec.conf"), 0644)
+	wantConf := systemConf + "# added by osx_vpn_manager\ninclude " + configDir + "/ipsec.d/osx_managed_vpn*.conf\n"
+	if conf != wantConf {
+		t.Errorf("ipsec.conf = %q, want %q", conf, wantConf)
+	}
+	secrets := readRendered(t, filepath.Join(configDir, "ipsec.secrets"), 0600)
+	wantSecrets := systemSecrets + "\n# added by osx_vpn_manager\ninclude " + configDir + "/ipsec.d/osx_managed_vpn*.secrets\n"
+	if secrets != wantSecrets {
+		t.Errorf("ipsec.secrets = %q, want %q", secrets, wantSecrets)
+	}
+	if _, err := os.Stat(filepath.Join(configDir, "xl2tpd", "xl2tpd.conf")); !os.IsNotExist(err) {
+		t.Errorf("the system xl2tpd.conf was written: %v", err)
+	}
+	if !backend.Show() {
+		t.Error("Show() = false after rendering")
+	}
+	err = ioutil.WriteFile(filepath.Join(configDir, "ipsec.conf"), []byte(systemConf), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backend.Show() {
+		t.Error("Show() = true without the ipsec.conf include")
+	}
+}
+
+func TestRenderStrongSwanConfigRefusesForeignFiles(t *testing.T) {
+	useTestResources(t)
+	configDir := t.TempDir()
+	slot := managedSlot(0)
+	foreign := filepath.Join(configDir, "ipsec.d", slot.Name+".conf")
+	err := os.MkdirAll(filepath.Dir(foreign), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(foreign, []byte("conn osx_managed_vpn\n\tright=198.51.100.1\n"), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = renderStrongSwanConfig(configDir, slot, testProfile, slot.Host)
+
+	if err == nil || !strings.Contains(err.Error(), "refusing to overwrite") {
+		t.Errorf("err = %v, want a refusal", err)
+	}
+	if file, _ := ioutil.ReadFile(foreign); !strings.Contains(string(file), "198.51.100.1") {
+		t.Errorf("%s was overwritten: %q", foreign, file)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// setupFakeConnections prepares two configured slots and two hosts in
+// separate VPCs
+func setupFakeConnections(t *testing.T) *fakeNetwork {
+	t.Helper()
+	useTestResources(t)
+	network := useFakeBackend(t)
+	config.MaxConnections = 2
+	for _, slot := range managedSlots() {
+		network.configured[slot.Name] = true
+	}
+	writeTestHosts(t,
+		testHost("alpha", "203.0.113.10", "10.1.0.0/16"),
+		testHost("beta", "203.0.113.20", "10.2.0.0/16", "10.3.0.0/16"),
+	)
+	storeProfiles([]vpnProfile{testProfile})
+	return network
+}
+
+func TestStartConnectionWithFakeBackend(t *testing.T) {
+	network := setupFakeConnections(t)
+	first, second := managedSlot(0), managedSlot(1)
+
+	startConnection("alpha", "test", connectOptions{})
+	if network.states[first.Name] != stateConnected {
+		t.Fatalf("%s state = %s, want connected", first.Name, network.states[first.Name])
+	}
+	if got, want := network.routes[first.Name], []string{"10.1.0.0/16"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("routes = %v, want %v", got, want)
+	}
+	session, found := loadSessionFile(first)
+	if !found || session.Name != "alpha" || session.Profile != "test" || session.Interface != "fake0" {
+		t.Errorf("session = %+v, found %v", session, found)
+	}
+	hosts, err := loadHostsFile(config.HostsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hosts.address(first.Host); got != "203.0.113.10" {
+		t.Errorf("%s points at %q, want 203.0.113.10", first.Host, got)
+	}
+
+	startConnection("beta", "test", connectOptions{keepExisting: true})
+	if network.states[first.Name] != stateConnected || network.states[second.Name] != stateConnected {
+		t.Fatalf("states = %v, want both slots connected", network.states)
+	}
+	if got, want := network.routes[second.Name], []string{"10.2.0.0/16", "10.3.0.0/16"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("routes = %v, want %v", got, want)
+	}
+	if session, _ := loadSessionFile(second); session.Name != "beta" {
+		t.Errorf("%s session is for %q, want beta", second.Name, session.Name)
+	}
+
+	//connecting without --keep-existing replaces the other connections
+	startConnection("alpha", "test", connectOptions{})
+	if network.states[second.Name] != stateDisconnected {
+		t.Errorf("%s state = %s, want disconnected", second.Name, network.states[second.Name])
+	}
+	if _, found := loadSessionFile(second); found {
+		t.Errorf("%s session was not cleared", second.Name)
+	}
+	if len(network.routes[second.Name]) != 0 {
+		t.Errorf("routes %v left behind on %s", network.routes[second.Name], second.Name)
+	}
+	hosts, err = loadHostsFile(config.HostsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hosts.address(second.Host); got != "" {
+		t.Errorf("%s still points at %s after disconnecting", second.Host, got)
+	}
+	if got := hosts.address(first.Host); got != "203.0.113.10" {
+		t.Errorf("%s points at %q, want 203.0.113.10", first.Host, got)
+	}
+}
+
+func TestStartConnectionDirectEndpoint(t *testing.T) {
+	network := setupFakeConnections(t)
+	config.EndpointMode = endpointModeDirect
+	startConnection("beta", "test", connectOptions{})
+	slot := managedSlot(0)
+	if got := network.endpoints[slot.Name]; got != "203.0.113.20" {
+		t.Errorf("endpoint = %q, want 203.0.113.20", got)
+	}
+	hosts, err := loadHostsFile(config.HostsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts.lines) != 0 {
+		t.Errorf("hosts file was edited in direct mode: %v", hosts.lines)
+	}
+}
+
+func TestDisconnectConnections(t *testing.T) {
+	tests := []struct {
+		name       string
+		identifier string
+		all        bool
+		keepRoutes bool
+		//hosts expected to still be connected
+		connected []string
+	}{
+		{name: "by name", identifier: "beta", connected: []string{"alpha"}},
+		{name: "by public ip", identifier: "203.0.113.10", connected: []string{"beta"}},
+		{name: "by slot", identifier: managedSlot(1).Name, connected: []string{"alpha"}},
+		{name: "all", all: true},
+		{name: "keep routes", identifier: "alpha", keepRoutes: true, connected: []string{"beta"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			network := setupFakeConnections(t)
+			startConnection("alpha", "test", connectOptions{})
+			startConnection("beta", "test", connectOptions{keepExisting: true})
+			routesBefore := map[string][]string{}
+			for name, routes := range network.routes {
+				routesBefore[name] = routes
+			}
+
+			disconnectConnections(test.identifier, test.all, test.keepRoutes)
+
+			var connected []string
+			for _, slot := range managedSlots() {
+				session, found := loadSessionFile(slot)
+				if network.states[slot.Name] == stateConnected {
+					if !found {
+						t.Errorf("%s is connected without a session", slot.Name)
+					}
+					connected = append(connected, session.Name)
+					continue
+				}
+				if found {
+					t.Errorf("%s session was not cleared", slot.Name)
+				}
+				if hosts, _ := loadHostsFile(config.HostsFile); hosts.address(slot.Host) != "" {
+					t.Errorf("%s was left in the hosts file", slot.Host)
+				}
+				if test.keepRoutes && !reflect.DeepEqual(network.routes[slot.Name], routesBefore[slot.Name]) {
+					t.Errorf("%s routes = %v, want %v kept", slot.Name, network.routes[slot.Name], routesBefore[slot.Name])
+				}
+				if !test.keepRoutes && len(network.routes[slot.Name]) != 0 {
+					t.Errorf("%s routes %v were not removed", slot.Name, network.routes[slot.Name])
+				}
+			}
+			if !reflect.DeepEqual(connected, test.connected) {
+				t.Errorf("connected = %v, want %v", connected, test.connected)
+			}
+		})
+	}
+}
+
+func TestStartConnectionToConnectedHost(t *testing.T) {
+	network := setupFakeConnections(t)
+	slot := managedSlot(0)
+	startConnection("beta", "test", connectOptions{})
+	//the routes are still installed, adding them again fails
+	network.failRoutes["10.2.0.0/16"] = true
+	network.failRoutes["10.3.0.0/16"] = true
+
+	startConnection("beta", "test", connectOptions{})
+	if network.starts[slot.Name] != 1 {
+		t.Errorf("connection was started %d times, want it left up", network.starts[slot.Name])
+	}
+	session, _ := loadSessionFile(slot)
+	if want := []string{"10.2.0.0/16", "10.3.0.0/16"}; !reflect.DeepEqual(session.Routes, want) {
+		t.Errorf("session routes = %v, want %v", session.Routes, want)
+	}
+
+	//a dropped connection to the same host is brought back up, the routes
+	//that could not be added again stay recorded
+	network.states[slot.Name] = stateDisconnected
+	delete(network.failRoutes, "10.3.0.0/16")
+	startConnection("beta", "test", connectOptions{})
+	if network.starts[slot.Name] != 2 {
+		t.Errorf("connection was started %d times, want 2", network.starts[slot.Name])
+	}
+	session, _ = loadSessionFile(slot)
+	if want := []string{"10.3.0.0/16", "10.2.0.0/16"}; !reflect.DeepEqual(session.Routes, want) {
+		t.Errorf("session routes = %v, want %v", session.Routes, want)
+	}
+}
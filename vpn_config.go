@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	configFilePath = path.Join(resourcePath, "config.yaml")
+	config         = defaultConfig()
+	configEnvRegex = regexp.MustCompile(`[^A-Z0-9]+`)
+)
+
+type vpnConfig struct {
+	Backend             string             `yaml:"backend"`
+	ManagedName         string             `yaml:"managed_name"`
+	ManagedHost         string             `yaml:"managed_host"`
+	HostsFile           string             `yaml:"hosts_file"`
+	EndpointMode        string             `yaml:"endpoint_mode"`
+	MaxConnections      int                `yaml:"max_connections"`
+	OverlappingRoutes   string             `yaml:"overlapping_routes"`
+	Watch               watchConfig        `yaml:"watch"`
+	ConnectTimeout      time.Duration      `yaml:"connect_timeout"`
+	ConnectPollInterval time.Duration      `yaml:"connect_poll_interval"`
+	MacOS               macOSConfig        `yaml:"macos"`
+	StrongSwan          strongSwanConfig   `yaml:"strongswan"`
+	Regions             awsRegionConfig    `yaml:"regions"`
+	AWS                 awsConfig          `yaml:"aws"`
+	Discovery           discoveryConfig    `yaml:"discovery"`
+	ProfileStore        profileStoreConfig `yaml:"profile_store"`
+	HostProfiles        []hostProfileRule  `yaml:"host_profiles"`
+}
+
+type macOSConfig struct {
+	Command     string `yaml:"command"`
+	SplitTunnel bool   `yaml:"split_tunnel"`
+}
+
+type strongSwanConfig struct {
+	ConfigDir   string `yaml:"config_dir"`
+	ControlFile string `yaml:"control_file"`
+	Interface   string `yaml:"interface"`
+}
+
+type awsRegionConfig struct {
+	Include  []string      `yaml:"include"`
+	Exclude  []string      `yaml:"exclude"`
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+type awsConfig struct {
+	EC2Endpoint     string `yaml:"ec2_endpoint"`
+	DiscoveryRegion string `yaml:"discovery_region"`
+	CredentialsFile string `yaml:"credentials_file"`
+}
+
+func defaultConfig() vpnConfig {
+	return vpnConfig{
+		Backend:           defaultBackend,
+		ManagedName:       "osx_managed_vpn",
+		ManagedHost:       "managedvpn.local",
+		HostsFile:         "/etc/hosts",
+		EndpointMode:      endpointModeHosts,
+		MaxConnections:    4,
+		OverlappingRoutes: overlapRefuse,
+		Watch: watchConfig{
+			Interval:   5 * time.Second,
+			MinBackoff: 2 * time.Second,
+			MaxBackoff: 2 * time.Minute,
+		},
+		ConnectTimeout:      10 * time.Second,
+		ConnectPollInterval: 500 * time.Millisecond,
+		MacOS: macOSConfig{
+			Command:     "macosvpn",
+			SplitTunnel: true,
+		},
+		StrongSwan: strongSwanConfig{
+			ConfigDir:   "/etc",
+			ControlFile: "/var/run/xl2tpd/l2tp-control",
+			Interface:   "ppp0",
+		},
+		Regions: awsRegionConfig{
+			CacheTTL: 24 * time.Hour,
+		},
+		AWS: awsConfig{
+			DiscoveryRegion: "us-east-1",
+			CredentialsFile: path.Join(os.Getenv("HOME"), ".aws", "credentials"),
+		},
+		ProfileStore: profileStoreConfig{
+			Encrypt: true,
+		},
+	}
+}
+
+func loadConfigFile() vpnConfig {
+	cfg := defaultConfig()
+	file, e := ioutil.ReadFile(configFilePath)
+	if e != nil {
+		if os.IsNotExist(e) {
+			return cfg
+		}
+		log.Fatalf("Could not read config file %s: %s", configFilePath, e)
+	}
+	err := yaml.Unmarshal(file, &cfg)
+	if err != nil {
+		log.Fatalf("Could not parse config file %s: %s", configFilePath, err)
+	}
+	return cfg
+}
+
+// yamlKey returns the yaml name of a struct field
+func yamlKey(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("yaml"), ",")[0]
+}
+
+// configField returns the field of cfg addressed by a dotted key such as
+// strongswan.config_dir
+func configField(cfg *vpnConfig, key string) (reflect.Value, error) {
+	value := reflect.ValueOf(cfg).Elem()
+	for _, name := range strings.Split(key, ".") {
+		if value.Kind() != reflect.Struct {
+			return reflect.Value{}, fmt.Errorf("unknown config key %s", key)
+		}
+		found := false
+		for i := 0; i < value.NumField(); i++ {
+			if yamlKey(value.Type().Field(i)) == name {
+				value = value.Field(i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return reflect.Value{}, fmt.Errorf("unknown config key %s", key)
+		}
+	}
+	return value, nil
+}
+
+// configKeys lists the dotted keys of every setting in the config
+func configKeys(valueType reflect.Type, prefix string) []string {
+	var keys []string
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		key := prefix + yamlKey(field)
+		if field.Type.Kind() == reflect.Struct {
+			keys = append(keys, configKeys(field.Type, key+".")...)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// configEnvName is the environment variable overriding key, e.g.
+// strongswan.config_dir is VPN_STRONGSWAN_CONFIG_DIR
+func configEnvName(key string) string {
+	return "VPN_" + configEnvRegex.ReplaceAllString(strings.ToUpper(key), "_")
+}
+
+// overrideConfigValue sets key on cfg from a YAML formatted value
+func overrideConfigValue(cfg *vpnConfig, key string, value string) error {
+	field, err := configField(cfg, key)
+	if err != nil {
+		return err
+	}
+	err = yaml.Unmarshal([]byte(value), field.Addr().Interface())
+	if err != nil {
+		return fmt.Errorf("invalid value for %s: %s", key, err)
+	}
+	return nil
+}
+
+// applyConfigOverrides layers VPN_* environment variables and then
+// --set key=value flags over the config file
+func applyConfigOverrides(cfg *vpnConfig, flagOverrides map[string]string) {
+	for _, key := range configKeys(reflect.TypeOf(*cfg), "") {
+		if value, ok := os.LookupEnv(configEnvName(key)); ok {
+			if err := overrideConfigValue(cfg, key, value); err != nil {
+				log.Fatalf("%s: %s", configEnvName(key), err)
+			}
+		}
+	}
+	for key, value := range flagOverrides {
+		if err := overrideConfigValue(cfg, key, value); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// applyConfig copies settings used as package globals out of the config
+func applyConfig() {
+	managedName = config.ManagedName
+	managedHost = config.ManagedHost
+	if config.EndpointMode != endpointModeHosts && config.EndpointMode != endpointModeDirect {
+		log.Fatalf("unknown endpoint_mode %s, expected %s or %s", config.EndpointMode, endpointModeHosts, endpointModeDirect)
+	}
+	if config.MaxConnections < 1 {
+		log.Fatalf("max_connections must be at least 1, got %d", config.MaxConnections)
+	}
+	if config.OverlappingRoutes != overlapRefuse && config.OverlappingRoutes != overlapWarn {
+		log.Fatalf("unknown overlapping_routes %s, expected %s or %s", config.OverlappingRoutes, overlapRefuse, overlapWarn)
+	}
+	awsCredentialFilePath = config.AWS.CredentialsFile
+}
+
+func showConfig() {
+	configYAML, err := yaml.Marshal(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Print(string(configYAML))
+}
+
+func getConfigValue(key string) {
+	field, err := configField(&config, key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if field.Kind() == reflect.String {
+		fmt.Println(field.String())
+		return
+	}
+	valueYAML, err := yaml.Marshal(field.Interface())
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Print(string(valueYAML))
+}
+
+// loadConfigDocument reads the config file as written, without defaults,
+// so it can be updated without losing its ordering or unset values
+func loadConfigDocument() yaml.MapSlice {
+	var document yaml.MapSlice
+	file, e := ioutil.ReadFile(configFilePath)
+	if e != nil {
+		if os.IsNotExist(e) {
+			return document
+		}
+		log.Fatalf("Could not read config file %s: %s", configFilePath, e)
+	}
+	err := yaml.Unmarshal(file, &document)
+	if err != nil {
+		log.Fatalf("Could not parse config file %s: %s", configFilePath, err)
+	}
+	return document
+}
+
+func setDocumentValue(document yaml.MapSlice, keyPath []string, value interface{}) yaml.MapSlice {
+	for index, item := range document {
+		if item.Key != keyPath[0] {
+			continue
+		}
+		if len(keyPath) == 1 {
+			document[index].Value = value
+		} else {
+			child, _ := item.Value.(yaml.MapSlice)
+			document[index].Value = setDocumentValue(child, keyPath[1:], value)
+		}
+		return document
+	}
+	if len(keyPath) == 1 {
+		return append(document, yaml.MapItem{Key: keyPath[0], Value: value})
+	}
+	return append(document, yaml.MapItem{Key: keyPath[0], Value: setDocumentValue(nil, keyPath[1:], value)})
+}
+
+// setConfigValue sets the dotted key in the config file and reloads it,
+// the updated file is validated before it is written
+func setConfigValue(key string, value interface{}) {
+	setConfigPath(strings.Split(key, "."), value)
+}
+
+// setConfigPath sets the value at keyPath in the config file, unlike
+// setConfigValue the keys may contain dots, such as AWS profile names
+func setConfigPath(keyPath []string, value interface{}) {
+	key := strings.Join(keyPath, ".")
+	unlock := lockResources()
+	defer unlock()
+	document := setDocumentValue(loadConfigDocument(), keyPath, value)
+	documentYAML, err := yaml.Marshal(document)
+	if err != nil {
+		log.Fatal(err)
+	}
+	validated := defaultConfig()
+	err = yaml.UnmarshalStrict(documentYAML, &validated)
+	if err != nil {
+		log.Fatalf("Could not set %s: %s", key, err)
+	}
+	writeError := writeFileAtomic(configFilePath, documentYAML, 0600)
+	if writeError != nil {
+		log.Fatalf("Could not write config file %s: %s", configFilePath, writeError)
+	}
+	config = loadConfigFile()
+}
+
+// setConfigCommand handles `config set`, value is parsed as YAML so lists
+// and durations can be given
+func setConfigCommand(key string, rawValue string) {
+	if _, err := configField(&config, key); err != nil {
+		log.Fatal(err)
+	}
+	var value interface{}
+	err := yaml.Unmarshal([]byte(rawValue), &value)
+	if err != nil {
+		log.Fatalf("Could not parse value for %s: %s", key, err)
+	}
+	setConfigValue(key, value)
+	fmt.Printf("%s updated in %s\n", key, configFilePath)
+}
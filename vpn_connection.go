@@ -1,228 +1,349 @@
 package main
 
-//todo use keychain to store psks instead of plaintext config file
-
 import (
 	"fmt"
 	"github.com/gernest/wow"
 	"github.com/gernest/wow/spin"
-	"github.com/lextoumbourou/goodhosts"
 	"log"
 	"os"
-	"os/exec"
 	"regexp"
 	"strconv"
-	"strings"
 	"time"
 )
 
 var (
 	managedName     = "osx_managed_vpn"
 	managedHost     = "managedvpn.local"
-	managedPSK      = "osx_managed_psk"
-	managedUserName = "osx_managed_un"
-	managedPW       = "osx_managed_pw"
-	macvpnCMD       = "macosvpn"
-	macvpnArgs      = []string{"create",
-		"--l2tp",
-		managedName,
-		"--endpoint",
-		managedHost,
-		"--username",
-		managedUserName,
-		"--password",
-		managedPW,
-		"--shared-secret",
-		managedPSK,
-		"--split",
-		"--force",
-	}
-	connectionRegex   = regexp.MustCompile(`^Connected`)
-	existingHostRegex = regexp.MustCompile(strings.Join([]string{managedHost, "$"}, ""))
-	vpcUIDRegex       = regexp.MustCompile(`^vpc-`)
-	vpcIndexRegex     = regexp.MustCompile(`\d?`)
-	sameConnection    bool
+	vpcUIDRegex     = regexp.MustCompile(`^vpc-`)
+	instanceIDRegex = regexp.MustCompile(`^i-`)
+	vpcIndexRegex   = regexp.MustCompile(`\d?`)
+)
+
+const (
+	//managedHost is pointed at the VPN host in the hosts file
+	endpointModeHosts = "hosts"
+	//the backend configuration is pointed at the VPN host's address
+	endpointModeDirect = "direct"
 )
 
-func createManagedVPN() {
-	cmd := exec.Command(macvpnCMD, macvpnArgs...)
-	err := cmd.Run()
+// connectOptions carries the connect command flags through startConnection
+type connectOptions struct {
+	keepRoutes   bool
+	keepExisting bool
+	ipv6         bool
+	awsProfile   string
+	region       string
+	dryRun       bool
+	watch        bool
+}
+
+func createManagedVPN(slot connectionSlot) {
+	err := slot.backend().Create()
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Printf("Created %s VPN configuration", managedName)
+	fmt.Printf("Created %s VPN configuration\n", slot.Name)
 }
 
-func updateManagedVPNHost(vpnHost vpnInstance) {
-	hosts, err := goodhosts.NewHosts()
+// vpnEndpoint returns the address the slot's backend should connect to for
+// vpnHost
+func vpnEndpoint(slot connectionSlot, vpnHost vpnInstance) string {
+	if config.EndpointMode == endpointModeDirect {
+		return vpnHost.PublicIP
+	}
+	return slot.Host
+}
+
+// updateManagedVPNHost points the slot's host name at the host in the hosts
+// file, with dryRun the edit is printed instead of written
+func updateManagedVPNHost(slot connectionSlot, vpnHost vpnInstance, dryRun bool) {
+	//other vpn processes edit the managed lines of the same hosts file
+	unlock := lockResources()
+	defer unlock()
+	hosts, err := loadHostsFile(config.HostsFile)
 	if err != nil {
-		log.Fatal("Could not read hostfile")
+		log.Fatalf("Could not read hosts file %s: %s", config.HostsFile, err)
 	}
-	if hosts.Has(vpnHost.PublicIP, managedHost) {
-		sameConnection = true
+	if hosts.address(slot.Host) == vpnHost.PublicIP {
+		if dryRun {
+			fmt.Printf("%s already points to %s\n", slot.Host, vpnHost.PublicIP)
+		}
 		return
 	}
-	removeExistingHost()
-	addManagedVPNHost(vpnHost)
+	fmt.Printf("Pointing %s at %s in %s\n", slot.Host, vpnHost.PublicIP, config.HostsFile)
+	hosts.setManagedHost(vpnHost.PublicIP, slot.Host)
+	if err := hosts.save(dryRun); err != nil {
+		log.Fatalf("Error writing host entry %s", err)
+	}
 }
 
-func needsDisconnection() bool {
-	var disconnect bool
-	if connectionEstablished() {
-		if sameConnection {
-			disconnect = false
-		} else {
-			disconnect = true
-		}
+// removeManagedVPNHost drops the slot's host name from the hosts file once
+// its connection is torn down
+func removeManagedVPNHost(slot connectionSlot) {
+	unlock := lockResources()
+	defer unlock()
+	hosts, err := loadHostsFile(config.HostsFile)
+	if err != nil {
+		log.Fatalf("Could not read hosts file %s: %s", config.HostsFile, err)
+	}
+	if hosts.address(slot.Host) == "" {
+		return
 	}
+	fmt.Printf("Removing %s from %s\n", slot.Host, config.HostsFile)
+	hosts.removeManagedHost(slot.Host)
+	if err := hosts.save(false); err != nil {
+		log.Fatalf("Error removing host entry %s", err)
+	}
+}
 
-	return disconnect
+func needsDisconnection(slot connectionSlot, vpnHost vpnInstance) bool {
+	if !connectionEstablished(slot) {
+		return false
+	}
+	session, found := loadSessionFile(slot)
+	return !found || !session.matches(vpnHost)
 }
 
-func disconnectExistingConnection() {
-	if needsDisconnection() {
-		fmt.Println("Disconnecting existing managed VPN connection")
-		disconnectConnection()
+func disconnectExistingConnection(slot connectionSlot, vpnHost vpnInstance, keepRoutes bool) {
+	if needsDisconnection(slot, vpnHost) {
+		fmt.Printf("Disconnecting existing managed VPN connection %s\n", slot.Name)
+		disconnectConnection(slot, keepRoutes)
 	}
 }
 
-func disconnectConnection() {
-	cmd := exec.Command("scutil",
-		"--nc",
-		"stop",
-		managedName,
-	)
-	err := cmd.Run()
-	if err != nil {
-		log.Fatal("Could not stop managed VPN connection")
+// disconnectOtherSlots tears down every connection except the one in slot,
+// used when connect is replacing existing connections
+func disconnectOtherSlots(slot connectionSlot, keepRoutes bool) {
+	for _, other := range slotsInUse() {
+		if other.Index != slot.Index {
+			fmt.Printf("Disconnecting existing managed VPN connection %s\n", other.Name)
+			disconnectConnection(other, keepRoutes)
+		}
 	}
 }
 
-func addManagedVPNHost(vpnHost vpnInstance) {
-	hosts, err := goodhosts.NewHosts()
-	if err != nil {
-		log.Fatal("Could not read hostfile")
+func disconnectConnection(slot connectionSlot, keepRoutes bool) {
+	backend := slot.backend()
+	session, found := loadSessionFile(slot)
+	if found && !keepRoutes {
+		removeRouting(backend, session.Routes)
 	}
-	err = hosts.Add(vpnHost.PublicIP, managedHost)
+	//cleared first so a running watch does not reconnect the connection
+	clearSessionFile(slot)
+	err := backend.Stop()
 	if err != nil {
-		log.Fatal("Could not add entry to host file")
+		log.Fatalf("Could not stop managed VPN connection %s", slot.Name)
 	}
-	if err := hosts.Flush(); err != nil {
-		log.Fatalf("Error writing host entry %s", err)
+	if config.EndpointMode == endpointModeHosts {
+		removeManagedVPNHost(slot)
 	}
 }
 
-func removeExistingHost() {
-	hosts, err := goodhosts.NewHosts()
-	if err != nil {
-		log.Fatal("Could not read hostfile")
-	}
-	for _, hostLine := range hosts.Lines {
-		if existingHostRegex.MatchString(hostLine.Raw) {
-			fmt.Printf("Removing `%s` from hostfile\n", hostLine.Raw)
-			err = hosts.Remove(hostLine.IP, hostLine.Hosts[0])
-			if err != nil {
-				log.Fatal("Could not remove old host entry")
+// disconnectConnections tears down the connections to identifier, every
+// connection with all, or the only connection when neither is given
+func disconnectConnections(identifier string, all bool, keepRoutes bool) {
+	inUse := slotsInUse()
+	var targets []connectionSlot
+	switch {
+	case identifier != "":
+		for _, slot := range inUse {
+			session, found := loadSessionFile(slot)
+			if slot.Name == identifier || (found && session.identifiedBy(identifier)) {
+				targets = append(targets, slot)
 			}
 		}
+		if len(targets) == 0 {
+			log.Fatalf("No managed VPN connection to %s", identifier)
+		}
+	case all || len(inUse) <= 1:
+		targets = inUse
+	default:
+		fmt.Println("Several managed VPN connections are up:")
+		for _, slot := range inUse {
+			session, _ := loadSessionFile(slot)
+			fmt.Printf("  %s: %s\n", slot.Name, session.Name)
+		}
+		log.Fatal("Name the host to disconnect or pass --all")
 	}
-	if err := hosts.Flush(); err != nil {
-		log.Fatalf("Error writing host entry %s", err)
+	if len(targets) == 0 {
+		//nothing recorded, stop the first slot as disconnect always has
+		targets = []connectionSlot{managedSlot(0)}
+	}
+	for _, slot := range targets {
+		disconnectConnection(slot, keepRoutes)
 	}
 }
 
-func establishManagedVPNConnection(vpnDetails vpnProfile, vpnHost *vpnInstance) {
-	cmd := exec.Command("scutil",
-		"--nc",
-		"start",
-		managedName,
-		"--user",
-		vpnDetails.UserName,
-		"--password",
-		vpnDetails.PassWord,
-		"--secret",
-		vpnDetails.Psk)
-	err := cmd.Run()
+func establishManagedVPNConnection(slot connectionSlot, vpnDetails vpnProfile, vpnHost *vpnInstance, options connectOptions) ([]string, bool) {
+	vpnDetails = applyOTP(vpnDetails)
+	backend := slot.backend()
+	err := backend.Start(vpnDetails, *vpnHost)
 	if err != nil {
-		log.Fatalf("Could not connect to vpn via scutil: %s", err)
+		log.Fatalf("Could not start managed VPN connection: %s", err)
 	}
-	i := 0
+	deadline := time.Now().Add(config.ConnectTimeout)
 	print("connecting...")
 	w := wow.New(os.Stdout, spin.Get(spin.BouncingBall), " Connecting")
 	w.Start()
 	for {
-		if connectionEstablished() {
+		if connectionEstablished(slot) {
 			w.Text(" Updating route table").Spinner(spin.Get(spin.Clock))
-			updateRouting(*vpnHost)
+			routes := updateRouting(backend, *vpnHost, options.ipv6)
 			w.Stop()
 			w.PersistWith(spin.Spinner{Frames: []string{"✅"}}, " Updating route table")
 			w.PersistWith(spin.Spinner{Frames: []string{"✅"}}, fmt.Sprintf(" VPN connection to %s established!!", vpnHost.Name))
-			break
-		} else if i < 20 {
-			i++
-			time.Sleep(500 * time.Millisecond)
+			return routes, true
+		} else if time.Now().Before(deadline) {
+			time.Sleep(config.ConnectPollInterval)
 		} else {
 			w.Stop()
 			w.PersistWith(spin.Spinner{Frames: []string{"‼️"}}, fmt.Sprintf(" Could not establish connection to VPN Host: %s", vpnHost.Name))
-			break
+			if _, err := backend.Status(); err != nil {
+				fmt.Printf("Could not read the status of %s: %s\n", slot.Name, err)
+			}
+			return nil, false
 		}
 	}
 }
 
-func verifyManagedVPNConnection() bool {
-	cmd := exec.Command("scutil",
-		"--nc",
-		"show",
-		managedName,
-	)
-	err := cmd.Run()
-	if err != nil {
-		return false
-	}
-	return true
+func verifyManagedVPNConnection(slot connectionSlot) bool {
+	return slot.backend().Show()
 }
 
-func setupManagedVPNConnection() {
-	if verifyManagedVPNConnection() {
+func setupManagedVPNConnection(slot connectionSlot) {
+	if verifyManagedVPNConnection(slot) {
 		return
 	}
-	log.Printf("Managed VPN `%s` not found, creating...\n", managedName)
-	createManagedVPN()
-	if verifyManagedVPNConnection() {
-		fmt.Println("Managed VPN settings applied, please rerun last command\n")
+	log.Printf("Managed VPN `%s` not found, creating...\n", slot.Name)
+	createManagedVPN(slot)
+	if verifyManagedVPNConnection(slot) {
+		fmt.Println("Managed VPN settings applied, please rerun last command")
 		os.Exit(0)
 	}
 	log.Fatal("Could not setup managed VPN connection\n")
 }
 
-func connectionEstablished() bool {
-	output, err := exec.Command("scutil", "--nc", "status", managedName).Output()
+// connectionEstablished reports whether the slot's connection is up. A
+// backend that can not report its status, such as strongSwan while charon
+// is not running, is treated as not connected
+func connectionEstablished(slot connectionSlot) bool {
+	status, err := slot.backend().Status()
 	if err != nil {
-		log.Fatal(err)
+		if DEBUG {
+			log.Printf("Could not read the status of %s: %s", slot.Name, err)
+		}
+		return false
 	}
-	if connectionRegex.MatchString(string(output)) {
-		return true
+	return status.State == stateConnected
+}
+
+// updateRouting routes each of the host's VPC CIDR blocks through the
+// connection and returns the routes that were installed
+func updateRouting(backend VPNBackend, vpnHost vpnInstance, includeIPv6 bool) []string {
+	cidrs := vpnHost.cidrBlocks()
+	if includeIPv6 {
+		cidrs = append(cidrs, vpnHost.VpcIpv6Cidrs...)
+	}
+	if len(cidrs) == 0 {
+		log.Fatalf("No CIDR blocks recorded for %s, try running `host refresh`\n", vpnHost.Name)
+	}
+	var routes []string
+	for _, cidr := range cidrs {
+		err := backend.AddRoute(cidr)
+		if err != nil {
+			fmt.Printf("Could not add route to %s after VPN connection: %s\n", cidr, err.Error())
+			continue
+		}
+		routes = append(routes, cidr)
 	}
-	return false
+	return routes
 }
 
-func updateRouting(vpnHost vpnInstance) {
-	cmd := exec.Command("route", "-v", "add", "-net", vpnHost.VpcCidr, "-interface", "ppp0")
-	err := cmd.Run()
-	if err != nil {
-		log.Fatalf("Could not update route table after VPN connection: %s\n", err.Error())
+// mergeRoutes adds the routes recorded for an earlier connection to the same
+// host to routes, routes still installed from that connection can not be
+// added again but must stay recorded so disconnect removes them
+func mergeRoutes(recorded []string, routes []string) []string {
+	merged := append([]string(nil), routes...)
+	for _, route := range recorded {
+		found := false
+		for _, existing := range merged {
+			found = found || existing == route
+		}
+		if !found {
+			merged = append(merged, route)
+		}
+	}
+	return merged
+}
+
+// removeRouting deletes routes installed by updateRouting, routes that have
+// already gone away with the interface are reported and skipped
+func removeRouting(backend VPNBackend, routes []string) {
+	for _, route := range routes {
+		fmt.Printf("Removing route to %s\n", route)
+		err := backend.DeleteRoute(route)
+		if err != nil {
+			fmt.Printf("Could not remove route to %s: %s\n", route, err)
+		}
+	}
+}
+
+// filterHosts returns the hosts from the given AWS profile and region,
+// empty values match every host
+func filterHosts(vpnHostsList vpnInstanceGrp, awsProfile string, region string) vpnInstanceGrp {
+	var filtered vpnInstanceGrp
+	for _, host := range vpnHostsList {
+		if awsProfile != "" && host.AWSProfile != awsProfile {
+			continue
+		}
+		if region != "" && host.Region != region {
+			continue
+		}
+		filtered = append(filtered, host)
+	}
+	return filtered
+}
+
+// uniqueHost returns the single host in matches, identifiers shared by hosts
+// in several accounts or regions must be narrowed with --aws-profile or
+// --region
+func uniqueHost(identifier string, matches vpnInstanceGrp) vpnInstance {
+	if len(matches) > 1 {
+		fmt.Printf("Multiple VPN hosts match `%s`:\n", identifier)
+		for _, host := range matches {
+			fmt.Printf("  %s (%s) aws profile: %s region: %s\n", host.Name, host.InstanceID, host.AWSProfile, host.Region)
+		}
+		log.Fatal("Use --aws-profile or --region to select one")
 	}
+	return matches[0]
 }
 
-func selectVPNHost(identifier string) vpnInstance {
+func selectVPNHost(identifier string, awsProfile string, region string) vpnInstance {
 	vpnHostsList := readHostsJSONFile()
+	candidates := filterHosts(vpnHostsList, awsProfile, region)
+	if instanceIDRegex.MatchString(identifier) {
+		fmt.Println("Connecting to VPN by instance ID")
+		var matches vpnInstanceGrp
+		for _, host := range candidates {
+			if host.InstanceID == identifier {
+				matches = append(matches, host)
+			}
+		}
+		if len(matches) > 0 {
+			return uniqueHost(identifier, matches)
+		}
+	}
 	if vpcUIDRegex.MatchString(identifier) {
 		fmt.Println("Connecting to VPN by UID")
-		for _, host := range vpnHostsList {
+		var matches vpnInstanceGrp
+		for _, host := range candidates {
 			if host.VpcID == identifier {
-				return host
+				matches = append(matches, host)
 			}
 		}
+		if len(matches) > 0 {
+			return uniqueHost(identifier, matches)
+		}
 	}
 	if vpcIndexRegex.MatchString(identifier) {
 		fmt.Println("Connecting to VPN by ID #")
@@ -233,20 +354,66 @@ func selectVPNHost(identifier string) vpnInstance {
 		}
 	}
 	fmt.Println("Connecting to VPN by instance Name")
-	for _, host := range vpnHostsList {
+	var matches vpnInstanceGrp
+	for _, host := range candidates {
 		if host.Name == identifier {
-			return host
+			matches = append(matches, host)
 		}
 	}
+	if len(matches) > 0 {
+		return uniqueHost(identifier, matches)
+	}
 	log.Fatal("Could not find VPN with provided identifier")
 	return vpnInstance{}
 }
 
-func startConnection(vpnIdentifier string, profileName string) {
-	setupManagedVPNConnection()
-	vpnHost := selectVPNHost(vpnIdentifier)
-	updateManagedVPNHost(vpnHost)
-	disconnectExistingConnection()
+func startConnection(vpnIdentifier string, profileName string, options connectOptions) {
+	vpnHost := selectVPNHost(vpnIdentifier, options.awsProfile, options.region)
+	slot := selectSlot(vpnHost, options.keepExisting)
+	if options.dryRun {
+		if config.EndpointMode == endpointModeDirect {
+			fmt.Printf("endpoint_mode is direct, %s would be configured as the endpoint and %s left untouched\n", vpnHost.PublicIP, config.HostsFile)
+			return
+		}
+		updateManagedVPNHost(slot, vpnHost, true)
+		return
+	}
+	previous, reconnecting := loadSessionFile(slot)
+	reconnecting = reconnecting && previous.matches(vpnHost)
+	if reconnecting && connectionEstablished(slot) {
+		fmt.Printf("Already connected to %s, leaving the connection as it is\n", vpnHost.Name)
+		if !options.keepExisting {
+			disconnectOtherSlots(slot, options.keepRoutes)
+		}
+		if options.watch {
+			newWatchdog([]connectionSlot{slot}).run()
+		}
+		return
+	}
+	if options.keepExisting {
+		checkOverlappingRoutes(slot, vpnHost, options.ipv6)
+	}
+	setupManagedVPNConnection(slot)
+	if profileName == "" {
+		profileName = profileForHost(vpnHost)
+	}
+	if !options.keepExisting {
+		disconnectOtherSlots(slot, options.keepRoutes)
+	}
+	disconnectExistingConnection(slot, vpnHost, options.keepRoutes)
+	if config.EndpointMode == endpointModeHosts {
+		updateManagedVPNHost(slot, vpnHost, false)
+	}
 	profile := selectVPNProfileDetails(profileName)
-	establishManagedVPNConnection(profile, &vpnHost)
+	routes, established := establishManagedVPNConnection(slot, profile, &vpnHost, options)
+	if !established {
+		return
+	}
+	if reconnecting {
+		routes = mergeRoutes(previous.Routes, routes)
+	}
+	writeSessionFile(slot, newConnectionSession(slot, vpnHost, profileName, routes))
+	if options.watch {
+		newWatchdog([]connectionSlot{slot}).run()
+	}
 }
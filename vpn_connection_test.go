@@ -0,0 +1,273 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// useRecordingRunner drives a single macos connection slot through a
+// recordingRunner, so scutil and route are never run
+func useRecordingRunner(t *testing.T) *recordingRunner {
+	t.Helper()
+	useTestResources(t)
+	config.Backend = "macos"
+	config.MaxConnections = 1
+	recorder := newRecordingRunner()
+	runner = recorder
+	writeTestHosts(t,
+		testHost("alpha", "203.0.113.10", "10.1.0.0/16"),
+		testHost("beta", "203.0.113.20", "10.2.0.0/16", "10.3.0.0/16"),
+	)
+	storeProfiles([]vpnProfile{testProfile})
+	return recorder
+}
+
+func sessionFor(vpnHost vpnInstance, routes ...string) connectionSession {
+	return connectionSession{
+		VpcID:      vpnHost.VpcID,
+		Name:       vpnHost.Name,
+		PublicIP:   vpnHost.PublicIP,
+		InstanceID: vpnHost.InstanceID,
+		Profile:    "test",
+		Routes:     routes,
+	}
+}
+
+func assertCalls(t *testing.T, recorder *recordingRunner, prefix string, want ...string) {
+	t.Helper()
+	if got := recorder.Ran(prefix); !reflect.DeepEqual(got, want) {
+		t.Errorf("ran %q, want %q", got, want)
+	}
+}
+
+func TestStartConnection(t *testing.T) {
+	recorder := useRecordingRunner(t)
+	recorder.On("scutil --nc show", "", 0)
+	recorder.On("scutil --nc status", "Connected\n  InterfaceName : ppp3\n", 0)
+	//down while other connections are checked and the existing one is
+	//looked at, up once started
+	recorder.Once("scutil --nc status", "Disconnected\n", 0)
+	recorder.Once("scutil --nc status", "Disconnected\n", 0)
+	recorder.On("route -v add -net 10.3.0.0/16", "route: writing to routing socket: File exists\n", 1)
+
+	startConnection("beta", "test", connectOptions{})
+
+	assertCalls(t, recorder, "scutil --nc start", "scutil --nc start osx_managed_vpn --user alice --password hunter2 --secret secret")
+	assertCalls(t, recorder, "scutil --nc stop")
+	assertCalls(t, recorder, "macosvpn")
+	assertCalls(t, recorder, "route",
+		"route -v add -net 10.2.0.0/16 -interface ppp3",
+		"route -v add -net 10.3.0.0/16 -interface ppp3",
+	)
+	session, found := loadSessionFile(managedSlot(0))
+	if !found {
+		t.Fatal("no session written")
+	}
+	if session.Name != "beta" || session.Profile != "test" || session.Interface != "ppp3" {
+		t.Errorf("session = %+v", session)
+	}
+	if want := []string{"10.2.0.0/16"}; !reflect.DeepEqual(session.Routes, want) {
+		t.Errorf("session routes = %v, want %v", session.Routes, want)
+	}
+}
+
+func TestDisconnectExistingConnection(t *testing.T) {
+	alpha := testHost("alpha", "203.0.113.10", "10.1.0.0/16")
+	beta := testHost("beta", "203.0.113.20", "10.2.0.0/16", "10.3.0.0/16")
+	tests := []struct {
+		name       string
+		status     string
+		connecting vpnInstance
+		keepRoutes bool
+		wantRoutes []string
+		wantStop   []string
+		keepsState bool
+	}{
+		{
+			name:       "other host",
+			status:     "Connected\n  InterfaceName : ppp1\n",
+			connecting: beta,
+			wantRoutes: []string{"route -v delete -net 10.1.0.0/16 -interface ppp1"},
+			wantStop:   []string{"scutil --nc stop osx_managed_vpn"},
+		},
+		{
+			name:       "other host keeping routes",
+			status:     "Connected\n  InterfaceName : ppp1\n",
+			connecting: beta,
+			keepRoutes: true,
+			wantStop:   []string{"scutil --nc stop osx_managed_vpn"},
+		},
+		{
+			name:       "same host",
+			status:     "Connected\n  InterfaceName : ppp1\n",
+			connecting: alpha,
+			keepsState: true,
+		},
+		{
+			name:       "not connected",
+			status:     "Disconnected\n",
+			connecting: beta,
+			keepsState: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := useRecordingRunner(t)
+			recorder.On("scutil --nc status", test.status, 0)
+			slot := managedSlot(0)
+			writeSessionFile(slot, sessionFor(alpha, "10.1.0.0/16"))
+
+			disconnectExistingConnection(slot, test.connecting, test.keepRoutes)
+
+			assertCalls(t, recorder, "route", test.wantRoutes...)
+			assertCalls(t, recorder, "scutil --nc stop", test.wantStop...)
+			if _, found := loadSessionFile(slot); found != test.keepsState {
+				t.Errorf("session found = %v, want %v", found, test.keepsState)
+			}
+		})
+	}
+}
+
+func TestSetupManagedVPNConnection(t *testing.T) {
+	recorder := useRecordingRunner(t)
+	recorder.On("scutil --nc show osx_managed_vpn", "", 0)
+
+	setupManagedVPNConnection(managedSlot(0))
+
+	assertCalls(t, recorder, "scutil", "scutil --nc show osx_managed_vpn")
+	assertCalls(t, recorder, "macosvpn")
+}
+
+func TestCreateManagedVPN(t *testing.T) {
+	recorder := useRecordingRunner(t)
+	config.MacOS.SplitTunnel = true
+
+	createManagedVPN(managedSlot(0))
+
+	assertCalls(t, recorder, "macosvpn", "macosvpn create --l2tp osx_managed_vpn --endpoint managedvpn.local --username osx_managed_un --password osx_managed_pw --shared-secret osx_managed_psk --split --force")
+}
+
+// TestSetupManagedVPNConnectionExits runs setupManagedVPNConnection in a
+// child process as it exits once the configuration has been created
+func TestSetupManagedVPNConnectionExits(t *testing.T) {
+	if scenario := os.Getenv("VPN_TEST_SETUP_SCENARIO"); scenario != "" {
+		recorder := useRecordingRunner(t)
+		recorder.Once("scutil --nc show", "", 1)
+		if scenario == "created" {
+			recorder.On("scutil --nc show", "", 0)
+		} else {
+			recorder.On("scutil --nc show", "", 1)
+		}
+		setupManagedVPNConnection(managedSlot(0))
+		t.Fatal("setupManagedVPNConnection returned")
+	}
+	tests := []struct {
+		scenario string
+		exitCode int
+		output   []string
+	}{
+		{"created", 0, []string{"Created osx_managed_vpn VPN configuration", "please rerun last command"}},
+		{"failed", 1, []string{"Could not setup managed VPN connection"}},
+	}
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			child := exec.Command(os.Args[0], "-test.run=^TestSetupManagedVPNConnectionExits$")
+			child.Env = append(os.Environ(), "VPN_TEST_SETUP_SCENARIO="+test.scenario)
+			output, err := child.CombinedOutput()
+			exitCode := 0
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				exitCode = exitErr.ExitCode()
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if exitCode != test.exitCode {
+				t.Errorf("exit code = %d, want %d\n%s", exitCode, test.exitCode, output)
+			}
+			for _, want := range test.output {
+				if !strings.Contains(string(output), want) {
+					t.Errorf("output = %q, want it to contain %q", output, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateRouting(t *testing.T) {
+	vpnHost := testHost("alpha", "203.0.113.10", "10.1.0.0/16", "10.2.0.0/16")
+	vpnHost.VpcIpv6Cidrs = []string{"2001:db8:1200::/56"}
+	tests := []struct {
+		name        string
+		includeIPv6 bool
+		wantCalls   []string
+		wantRoutes  []string
+	}{
+		{
+			name: "ipv4",
+			wantCalls: []string{
+				"route -v add -net 10.1.0.0/16 -interface ppp2",
+				"route -v add -net 10.2.0.0/16 -interface ppp2",
+			},
+			wantRoutes: []string{"10.1.0.0/16"},
+		},
+		{
+			name:        "ipv6",
+			includeIPv6: true,
+			wantCalls: []string{
+				"route -v add -net 10.1.0.0/16 -interface ppp2",
+				"route -v add -net 10.2.0.0/16 -interface ppp2",
+				"route -v add -inet6 -net 2001:db8:1200::/56 -interface ppp2",
+			},
+			wantRoutes: []string{"10.1.0.0/16", "2001:db8:1200::/56"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := useRecordingRunner(t)
+			recorder.On("scutil --nc status", "Connected\n  InterfaceName : ppp2\n", 0)
+			recorder.On("route -v add -net 10.2.0.0/16", "route: writing to routing socket: File exists\n", 1)
+
+			routes := updateRouting(managedSlot(0).backend(), vpnHost, test.includeIPv6)
+
+			assertCalls(t, recorder, "route", test.wantCalls...)
+			if !reflect.DeepEqual(routes, test.wantRoutes) {
+				t.Errorf("routes = %v, want %v", routes, test.wantRoutes)
+			}
+		})
+	}
+}
+
+func TestStatusErrorIsNotConnected(t *testing.T) {
+	tests := []struct {
+		backend string
+		status  string
+	}{
+		{"macos", "scutil --nc status"},
+		//ipsec status fails while charon is not running
+		{"strongswan", "ipsec status"},
+	}
+	for _, test := range tests {
+		t.Run(test.backend, func(t *testing.T) {
+			recorder := useRecordingRunner(t)
+			config.Backend = test.backend
+			config.StrongSwan.ConfigDir = t.TempDir()
+			recorder.On(test.status, "", 1)
+			slot := managedSlot(0)
+			writeSessionFile(slot, sessionFor(testHost("alpha", "203.0.113.10", "10.1.0.0/16"), "10.1.0.0/16"))
+
+			if connectionEstablished(slot) {
+				t.Error("connectionEstablished = true when the status could not be read")
+			}
+			disconnectExistingConnection(slot, testHost("beta", "203.0.113.20", "10.2.0.0/16"), false)
+
+			if _, found := loadSessionFile(slot); !found {
+				t.Error("session cleared without a connection to disconnect")
+			}
+			if len(recorder.Ran(test.status)) == 0 {
+				t.Errorf("%s was not run", test.status)
+			}
+		})
+	}
+}
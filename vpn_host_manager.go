@@ -7,7 +7,6 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/olekukonko/tablewriter"
-	"io/ioutil"
 	"log"
 	"path"
 	"strings"
@@ -19,116 +18,177 @@ import (
 	"sync"
 )
 
-var awsRegions = []string{"us-east-1", "us-west-1", "us-west-2", "eu-west-1", "eu-central-1", "sa-east-1"}
 var hostFilePath = path.Join(resourcePath, "vpn_hosts.json")
-var vpnInstanceFieldNames = []string{"ID #", "VPC ID", "VPN Name", "Environment", "Public IP", "VPC CIDR"}
+var vpnInstanceFieldNames = []string{"ID #", "VPC ID", "VPN Name", "Environment", "Public IP", "VPC CIDR", "AWS Profile", "Region", "Instance ID"}
 
 type vpnInstance struct {
-	VpcID       string `json:"vpc_id"`
-	Name        string `json:"name"`
-	Environment string `json:"environment"`
-	PublicIP    string `json:"public_ip"`
-	VpcCidr     string `json:"vpc_cidr"`
+	VpcID        string   `json:"vpc_id"`
+	Name         string   `json:"name"`
+	Environment  string   `json:"environment"`
+	PublicIP     string   `json:"public_ip"`
+	VpcCidr      string   `json:"vpc_cidr"`
+	VpcCidrs     []string `json:"vpc_cidrs,omitempty"`
+	VpcIpv6Cidrs []string `json:"vpc_ipv6_cidrs,omitempty"`
+	AWSProfile   string   `json:"aws_profile"`
+	Region       string   `json:"region"`
+	InstanceID   string   `json:"instance_id"`
 }
 type vpnInstanceGrp []vpnInstance
 
-func listVPCs(profile string) map[string]string {
+// regionInstance is an EC2 instance along with the region it was found in
+type regionInstance struct {
+	region   string
+	instance *ec2.Instance
+}
+
+// vpcCidrSet holds the CIDR blocks associated with a VPC, the primary IPv4
+// block is always first
+type vpcCidrSet struct {
+	ipv4 []string
+	ipv6 []string
+}
+
+// cidrBlocks returns every IPv4 block of the instance's VPC, falling back to
+// the primary block for host files written before secondary blocks were
+// recorded
+func (v vpnInstance) cidrBlocks() []string {
+	if len(v.VpcCidrs) > 0 {
+		return v.VpcCidrs
+	}
+	if v.VpcCidr == "" {
+		return nil
+	}
+	return []string{v.VpcCidr}
+}
+
+func vpcCidrBlocks(vpc *ec2.Vpc) vpcCidrSet {
+	cidrs := vpcCidrSet{ipv4: []string{*vpc.CidrBlock}}
+	for _, association := range vpc.CidrBlockAssociationSet {
+		if association.CidrBlock == nil || *association.CidrBlock == *vpc.CidrBlock {
+			continue
+		}
+		if association.CidrBlockState != nil && aws.StringValue(association.CidrBlockState.State) != "associated" {
+			continue
+		}
+		cidrs.ipv4 = append(cidrs.ipv4, *association.CidrBlock)
+	}
+	for _, association := range vpc.Ipv6CidrBlockAssociationSet {
+		if association.Ipv6CidrBlock == nil {
+			continue
+		}
+		if association.Ipv6CidrBlockState != nil && aws.StringValue(association.Ipv6CidrBlockState.State) != "associated" {
+			continue
+		}
+		cidrs.ipv6 = append(cidrs.ipv6, *association.Ipv6CidrBlock)
+	}
+	return cidrs
+}
+
+// ec2Client returns an EC2 client for the profile and region, requests go
+// to the configured ec2_endpoint instead of AWS when one is set
+func ec2Client(profile string, region string) *ec2.EC2 {
+	sessionConfig := &aws.Config{Region: aws.String(region),
+		Credentials: credentials.NewCredentials(&credentials.SharedCredentialsProvider{
+			Profile: profile,
+		}),
+	}
+	if config.AWS.EC2Endpoint != "" {
+		sessionConfig.Endpoint = aws.String(config.AWS.EC2Endpoint)
+	}
+	session, err := session.NewSession(sessionConfig)
+	if err != nil {
+		log.Fatalln("Could not establish new AWS session", err)
+	}
+	return ec2.New(session)
+}
+
+func listVPCs(profile string, regions []string, vpcIDs []string) map[string]vpcCidrSet {
 	type o struct {
-		vpcid, vpcidr string
+		vpcid  string
+		vpcidr vpcCidrSet
 	}
-	vpcList := make(map[string]string)
+	vpcList := make(map[string]vpcCidrSet)
 	var wg sync.WaitGroup
 	resChan := make(chan o)
+	collected := make(chan bool)
 	go func(res chan o) {
 		for a := range res {
 			vpcList[a.vpcid] = a.vpcidr
 		}
+		close(collected)
 	}(resChan)
-	for _, region := range awsRegions {
+	for _, region := range regions {
 		wg.Add(1)
 		go func(profile string, reg string, x *sync.WaitGroup, c chan o) {
 			fmt.Printf("fetching vpc details for region: %v\n", reg)
-			session, err := session.NewSession(&aws.Config{Region: aws.String(reg),
-				Credentials: credentials.NewCredentials(&credentials.SharedCredentialsProvider{
-					Profile: profile,
-				}),
-			})
-			if err != nil {
-				log.Fatalln("Could not establish new AWS session", err)
-			}
-			svc := ec2.New(session)
+			svc := ec2Client(profile, reg)
 			params := &ec2.DescribeVpcsInput{}
-			resp, err := svc.DescribeVpcs(params)
+			//VpcIds fails the whole call with InvalidVpcID.NotFound in regions
+			//that do not hold every listed VPC, a filter just matches nothing
+			if len(vpcIDs) > 0 {
+				params.Filters = []*ec2.Filter{{
+					Name:   aws.String("vpc-id"),
+					Values: aws.StringSlice(vpcIDs),
+				}}
+			}
+			err := svc.DescribeVpcsPages(params, func(page *ec2.DescribeVpcsOutput, lastPage bool) bool {
+				for _, vpc := range page.Vpcs {
+					vpcID := *vpc.VpcId
+					vpcCIDRs := vpcCidrBlocks(vpc)
+					c <- o{vpcID, vpcCIDRs}
+				}
+				return true
+			})
 			if err != nil {
 				fmt.Println("there was an error listing vpcs in", reg, err.Error())
 				log.Fatal(err.Error())
 			}
-			for _, vpc := range resp.Vpcs {
-				vpcID := *vpc.VpcId
-				vpcCIDR := *vpc.CidrBlock
-				c <- o{vpcID, vpcCIDR}
-			}
 			x.Done()
 		}(profile, region, &wg, resChan)
 	}
 	wg.Wait()
 	close(resChan)
+	<-collected
 	return vpcList
 }
 
-func listFilteredInstances(nameFilter string, profile string) []*ec2.Instance {
-	var filteredInstances []*ec2.Instance
+func listFilteredInstances(filter discoveryFilter, profile string, regions []string) []regionInstance {
+	var filteredInstances []regionInstance
 	var instanceWG sync.WaitGroup
-	instanceResChan := make(chan *ec2.Instance)
-	go func(res chan *ec2.Instance) {
+	instanceResChan := make(chan regionInstance)
+	collected := make(chan bool)
+	go func(res chan regionInstance) {
 		for a := range res {
 			filteredInstances = append(filteredInstances, a)
 		}
+		close(collected)
 	}(instanceResChan)
-	for _, region := range awsRegions {
+	for _, region := range regions {
 		instanceWG.Add(1)
-		go func(profile string, reg string, x *sync.WaitGroup, ic chan *ec2.Instance) {
-			session, err := session.NewSession(&aws.Config{Region: aws.String(reg),
-				Credentials: credentials.NewCredentials(&credentials.SharedCredentialsProvider{
-					Profile: profile,
-				}),
-			})
-			if err != nil {
-				log.Fatalln("Could not establish new AWS session", err)
-			}
-			svc := ec2.New(session)
-			fmt.Printf("fetching instances with tag %v in: %v\n", nameFilter, reg)
+		go func(profile string, reg string, x *sync.WaitGroup, ic chan regionInstance) {
+			svc := ec2Client(profile, reg)
+			fmt.Printf("fetching instances with tags %v in: %v\n", filter, reg)
 			params := &ec2.DescribeInstancesInput{
-				Filters: []*ec2.Filter{
-					{
-						Name: aws.String("tag:Name"),
-						Values: []*string{
-							aws.String(strings.Join([]string{"*", nameFilter, "*"}, "")),
-						},
-					},
-					{
-						Name: aws.String("instance-state-name"),
-						Values: []*string{
-							aws.String("running"),
-						},
-					},
-				},
+				Filters: filter.instanceFilters(),
 			}
-			resp, err := svc.DescribeInstances(params)
+			err := svc.DescribeInstancesPages(params, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+				for _, reservation := range page.Reservations {
+					for _, instance := range reservation.Instances {
+						ic <- regionInstance{reg, instance}
+					}
+				}
+				return true
+			})
 			if err != nil {
 				fmt.Println("there was an error listing instnaces in", reg, err.Error())
 				log.Fatal(err.Error())
 			}
-			for _, reservation := range resp.Reservations {
-				for _, instance := range reservation.Instances {
-					ic <- instance
-				}
-			}
 			x.Done()
 		}(profile, region, &instanceWG, instanceResChan)
 	}
 	instanceWG.Wait()
 	close(instanceResChan)
+	<-collected
 	return filteredInstances
 }
 
@@ -143,19 +203,32 @@ func extractTagValue(tagList []*ec2.Tag, lookup string) string {
 	return tagVale
 }
 
-func listVpnInstnaces(vpcCidrs map[string]string, profile string) vpnInstanceGrp {
+func listVpnInstnaces(vpcCidrs map[string]vpcCidrSet, profile string, regions []string, filter discoveryFilter) vpnInstanceGrp {
 	var vpnInstances vpnInstanceGrp
-	vpnInstanceList := listFilteredInstances("vpn", profile)
-	for _, instance := range vpnInstanceList {
+	vpnInstanceList := listFilteredInstances(filter, profile, regions)
+	for _, found := range vpnInstanceList {
+		instance := found.instance
 		if DEBUG {
 			fmt.Printf("%+v\n\n", instance)
 		}
+		if instance.PublicIpAddress == nil {
+			fmt.Printf("Skipping %s (%s) in %s, it has no public IP\n", extractTagValue(instance.Tags, filter.NameTag), aws.StringValue(instance.InstanceId), found.region)
+			continue
+		}
+		cidrs := vpcCidrs[*instance.VpcId]
 		vpn := vpnInstance{
-			VpcID:       *instance.VpcId,
-			VpcCidr:     vpcCidrs[*instance.VpcId],
-			Name:        extractTagValue(instance.Tags, "Name"),
-			Environment: extractTagValue(instance.Tags, "environment"),
-			PublicIP:    *instance.PublicIpAddress,
+			VpcID:        *instance.VpcId,
+			VpcCidrs:     cidrs.ipv4,
+			VpcIpv6Cidrs: cidrs.ipv6,
+			Name:         extractTagValue(instance.Tags, filter.NameTag),
+			Environment:  extractTagValue(instance.Tags, filter.EnvironmentTag),
+			PublicIP:     *instance.PublicIpAddress,
+			AWSProfile:   profile,
+			Region:       found.region,
+			InstanceID:   *instance.InstanceId,
+		}
+		if len(cidrs.ipv4) > 0 {
+			vpn.VpcCidr = cidrs.ipv4[0]
 		}
 		vpnInstances = append(vpnInstances, vpn)
 	}
@@ -169,30 +242,56 @@ func writevpnDetailFile(vpnList vpnInstanceGrp) {
 		return
 	}
 	fmt.Printf("Writing host file to %s\n", hostFilePath)
-	werror := ioutil.WriteFile(hostFilePath, vpnJSON, 0755)
-	if werror != nil {
-		fmt.Printf("Could not write host file to path %s\n", hostFilePath)
-		log.Fatal(werror)
+	writeResourceFile(hostFilePath, vpnJSON)
+}
+
+// retainedHosts returns the existing hosts that a refresh limited to
+// refreshedProfiles should leave untouched
+func retainedHosts(refreshedProfiles []string) vpnInstanceGrp {
+	var retained vpnInstanceGrp
+	if _, err := os.Stat(hostFilePath); os.IsNotExist(err) {
+		return retained
+	}
+	refreshed := make(map[string]bool)
+	for _, awsProfile := range refreshedProfiles {
+		refreshed[awsProfile] = true
 	}
+	for _, host := range readHostsJSONFile() {
+		if !refreshed[host.AWSProfile] {
+			retained = append(retained, host)
+		}
+	}
+	return retained
 }
 
-func refreshHosts() {
+func refreshHosts(forceRegionDiscovery bool, onlyProfiles []string) {
 	awsProfiles := awsProfiles()
+	if len(onlyProfiles) > 0 {
+		awsProfiles = onlyProfiles
+	}
 	var vpnHostList vpnInstanceGrp
 	for _, awsProfile := range awsProfiles {
 		fmt.Printf("Refreshing hosts list for profile: %s\n", awsProfile)
-		vpcList := listVPCs(awsProfile)
-		vpn := listVpnInstnaces(vpcList, awsProfile)
-		//todo, add profile to instances. create function to do so
+		regions := awsRegions(awsProfile, forceRegionDiscovery)
+		filter := config.Discovery.forProfile(awsProfile)
+		vpcList := listVPCs(awsProfile, regions, filter.VpcIDs)
+		vpn := listVpnInstnaces(vpcList, awsProfile, regions, filter)
 		vpnHostList = append(vpnHostList, vpn...)
 		fmt.Println("======")
 	}
+	//the hosts of the other profiles are read under the lock so a
+	//concurrent refresh of another profile is not lost
+	unlock := lockResources()
+	defer unlock()
+	if len(onlyProfiles) > 0 {
+		vpnHostList = append(retainedHosts(onlyProfiles), vpnHostList...)
+	}
 	writevpnDetailFile(vpnHostList)
-	fmt.Println("complete\n")
+	fmt.Println("complete")
 }
 
 func readHostsJSONFile() vpnInstanceGrp {
-	file, e := ioutil.ReadFile(hostFilePath)
+	file, e := readResourceFile(hostFilePath)
 	if e != nil {
 		fmt.Printf("File error: %v\n", e)
 		os.Exit(1)
@@ -217,7 +316,10 @@ func printVPNHostList() {
 			vpnHost.Name,
 			vpnHost.Environment,
 			vpnHost.PublicIP,
-			vpnHost.VpcCidr,
+			strings.Join(append(vpnHost.cidrBlocks(), vpnHost.VpcIpv6Cidrs...), "\n"),
+			vpnHost.AWSProfile,
+			vpnHost.Region,
+			vpnHost.InstanceID,
 		}
 		consoleTable.Append(row)
 	}
@@ -229,7 +331,13 @@ func (slice vpnInstanceGrp) Len() int {
 }
 
 func (slice vpnInstanceGrp) Less(i, j int) bool {
-	return slice[i].Name < slice[j].Name
+	if slice[i].Name != slice[j].Name {
+		return slice[i].Name < slice[j].Name
+	}
+	if slice[i].AWSProfile != slice[j].AWSProfile {
+		return slice[i].AWSProfile < slice[j].AWSProfile
+	}
+	return slice[i].Region < slice[j].Region
 }
 
 func (slice vpnInstanceGrp) Swap(i, j int) {
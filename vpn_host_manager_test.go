@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeEC2 answers DescribeVpcs and DescribeInstances query API requests
+// with pages of canned XML, the NextToken of a page is the index of the
+// next one
+type fakeEC2 struct {
+	mu       sync.Mutex
+	pages    map[string][]string
+	requests []string
+	forms    []url.Values
+}
+
+func (f *fakeEC2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	action, token := r.Form.Get("Action"), r.Form.Get("NextToken")
+	f.mu.Lock()
+	f.requests = append(f.requests, strings.TrimSpace(action+" "+token))
+	f.forms = append(f.forms, r.Form)
+	f.mu.Unlock()
+	pages, found := f.pages[action]
+	if !found {
+		http.Error(w, "unsupported action "+action, http.StatusBadRequest)
+		return
+	}
+	index := 0
+	if token != "" {
+		index, err = strconv.Atoi(token)
+		if err != nil || index >= len(pages) {
+			http.Error(w, "bad NextToken "+token, http.StatusBadRequest)
+			return
+		}
+	}
+	nextToken := ""
+	if index+1 < len(pages) {
+		nextToken = fmt.Sprintf("<nextToken>%d</nextToken>", index+1)
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<%sResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+<requestId>test</requestId>
+%s
+%s
+</%sResponse>`, action, pages[index], nextToken, action)
+}
+
+func vpcXML(vpcID string, cidrs ...string) string {
+	var associations string
+	for _, cidr := range cidrs {
+		associations += fmt.Sprintf("<item><cidrBlock>%s</cidrBlock><cidrBlockState><state>associated</state></cidrBlockState></item>", cidr)
+	}
+	return fmt.Sprintf("<item><vpcId>%s</vpcId><cidrBlock>%s</cidrBlock><cidrBlockAssociationSet>%s</cidrBlockAssociationSet></item>", vpcID, cidrs[0], associations)
+}
+
+func instanceXML(instanceID string, vpcID string, publicIP string, name string) string {
+	ipAddress := ""
+	if publicIP != "" {
+		ipAddress = fmt.Sprintf("<ipAddress>%s</ipAddress>", publicIP)
+	}
+	return fmt.Sprintf("<item><instanceId>%s</instanceId><vpcId>%s</vpcId>%s<tagSet><item><key>Name</key><value>%s</value></item><item><key>Environment</key><value>test</value></item></tagSet></item>", instanceID, vpcID, ipAddress, name)
+}
+
+func reservationXML(instances ...string) string {
+	return "<item><reservationId>r-1</reservationId><instancesSet>" + strings.Join(instances, "") + "</instancesSet></item>"
+}
+
+// useFakeEC2 points ec2_endpoint at a fakeEC2 serving pages and provides
+// credentials for the test profile
+func useFakeEC2(t *testing.T, pages map[string][]string) *fakeEC2 {
+	t.Helper()
+	dir := useTestResources(t)
+	credentialsFile := path.Join(dir, "credentials")
+	err := ioutil.WriteFile(credentialsFile, []byte("[test]\naws_access_key_id = AKIDTEST\naws_secret_access_key = secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+	server := &fakeEC2{pages: pages}
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	config.AWS.EC2Endpoint = httpServer.URL
+	return server
+}
+
+func TestDiscoveryFollowsNextToken(t *testing.T) {
+	server := useFakeEC2(t, map[string][]string{
+		"DescribeVpcs": {
+			"<vpcSet>" + vpcXML("vpc-a", "10.1.0.0/16") + "</vpcSet>",
+			"<vpcSet>" + vpcXML("vpc-b", "10.2.0.0/16", "10.20.0.0/16") + "</vpcSet>",
+		},
+		"DescribeInstances": {
+			"<reservationSet>" + reservationXML(
+				instanceXML("i-a1", "vpc-a", "203.0.113.1", "alpha-vpn"),
+				instanceXML("i-a2", "vpc-a", "203.0.113.2", "alpha-vpn-2"),
+			) + "</reservationSet>",
+			"<reservationSet>" + reservationXML(
+				instanceXML("i-b1", "vpc-b", "203.0.113.3", "beta-vpn"),
+			) + "</reservationSet>",
+			"<reservationSet>" + reservationXML(
+				instanceXML("i-b2", "vpc-b", "203.0.113.4", "beta-vpn-2"),
+			) + "</reservationSet>",
+		},
+	})
+	regions := []string{"eu-west-1"}
+	filter := discoveryFilter{NameTag: "Name", EnvironmentTag: "Environment"}
+
+	vpcs := listVPCs("test", regions, nil)
+	hosts := listVpnInstnaces(vpcs, "test", regions, filter)
+
+	wantVPCs := map[string]vpcCidrSet{
+		"vpc-a": {ipv4: []string{"10.1.0.0/16"}},
+		"vpc-b": {ipv4: []string{"10.2.0.0/16", "10.20.0.0/16"}},
+	}
+	if !reflect.DeepEqual(vpcs, wantVPCs) {
+		t.Errorf("listVPCs = %v, want %v", vpcs, wantVPCs)
+	}
+	sort.Sort(hosts)
+	var got []string
+	for _, host := range hosts {
+		got = append(got, fmt.Sprintf("%s %s %s %s %v", host.Name, host.InstanceID, host.PublicIP, host.Environment, host.cidrBlocks()))
+	}
+	want := []string{
+		"alpha-vpn i-a1 203.0.113.1 test [10.1.0.0/16]",
+		"alpha-vpn-2 i-a2 203.0.113.2 test [10.1.0.0/16]",
+		"beta-vpn i-b1 203.0.113.3 test [10.2.0.0/16 10.20.0.0/16]",
+		"beta-vpn-2 i-b2 203.0.113.4 test [10.2.0.0/16 10.20.0.0/16]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("hosts = %q, want %q", got, want)
+	}
+	wantRequests := []string{"DescribeVpcs", "DescribeVpcs 1", "DescribeInstances", "DescribeInstances 1", "DescribeInstances 2"}
+	if !reflect.DeepEqual(server.requests, wantRequests) {
+		t.Errorf("requests = %q, want %q", server.requests, wantRequests)
+	}
+}
+
+func TestListVPCsFiltersByVpcID(t *testing.T) {
+	server := useFakeEC2(t, map[string][]string{
+		"DescribeVpcs": {"<vpcSet>" + vpcXML("vpc-a", "10.1.0.0/16") + "</vpcSet>"},
+	})
+
+	vpcs := listVPCs("test", []string{"eu-west-1"}, []string{"vpc-a", "vpc-elsewhere"})
+
+	if len(vpcs) != 1 {
+		t.Errorf("listVPCs = %v, want vpc-a", vpcs)
+	}
+	form := server.forms[0]
+	if form.Get("Filter.1.Name") != "vpc-id" || form.Get("Filter.1.Value.1") != "vpc-a" || form.Get("Filter.1.Value.2") != "vpc-elsewhere" {
+		t.Errorf("request filters = %v, want a vpc-id filter", form)
+	}
+	for key := range form {
+		if strings.HasPrefix(key, "VpcId.") {
+			t.Errorf("request lists %s=%s, VPCs missing from the region would fail the call", key, form.Get(key))
+		}
+	}
+}
+
+func TestDiscoverySkipsInstancesWithoutPublicIP(t *testing.T) {
+	useFakeEC2(t, map[string][]string{
+		"DescribeVpcs": {"<vpcSet>" + vpcXML("vpc-a", "10.1.0.0/16") + "</vpcSet>"},
+		"DescribeInstances": {"<reservationSet>" + reservationXML(
+			instanceXML("i-stopped", "vpc-a", "", "stopped-vpn"),
+			instanceXML("i-a1", "vpc-a", "203.0.113.1", "alpha-vpn"),
+		) + "</reservationSet>"},
+	})
+	regions := []string{"eu-west-1"}
+
+	hosts := listVpnInstnaces(listVPCs("test", regions, nil), "test", regions, discoveryFilter{NameTag: "Name"})
+
+	if len(hosts) != 1 || hosts[0].InstanceID != "i-a1" {
+		t.Errorf("hosts = %+v, want only i-a1", hosts)
+	}
+}
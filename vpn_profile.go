@@ -4,16 +4,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/olekukonko/tablewriter"
+	"golang.org/x/term"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"regexp"
 	"strconv"
+	"strings"
 )
 
 var (
-	vpnProfileFields    = []string{"ID #", "Name", "Username"}
+	vpnProfileFields    = []string{"ID #", "Name", "Username", "OTP"}
 	vpnProfileFilePath  = path.Join(resourcePath, "vpn_profiles.json")
 	noSuchFileErrRegexp = regexp.MustCompile(`no such file or directory`)
 )
@@ -23,10 +25,14 @@ type vpnProfile struct {
 	Psk      string `json:"psk"`
 	UserName string `json:"username"`
 	PassWord string `json:"password"`
+	OTPMode  string `json:"otp_mode,omitempty"`
+	TOTPSeed string `json:"totp_seed,omitempty"`
+	//host connected to when `connect` is given no identifier
+	DefaultHost string `json:"default_host,omitempty"`
 }
 
 func loadProfileFile() []vpnProfile {
-	file, e := ioutil.ReadFile(vpnProfileFilePath)
+	file, e := readResourceFile(vpnProfileFilePath)
 	if e != nil {
 		if noSuchFileErrRegexp.MatchString(e.Error()) {
 			return []vpnProfile{}
@@ -35,26 +41,31 @@ func loadProfileFile() []vpnProfile {
 		os.Exit(1)
 	}
 	var profiles []vpnProfile
-	err := json.Unmarshal(file, &profiles)
+	err := json.Unmarshal(decodeProfileStore(file), &profiles)
 	if err != nil {
 		log.Fatal("Could not load vpn profiles")
 	}
+	if config.ProfileStore.Encrypt && isPlaintextProfileStore(file) {
+		migrateProfileStore(profiles)
+	}
 	return profiles
 }
 
-func writeProfileFile(profileList []vpnProfile) {
+// storeProfiles writes the profile list, encrypting it when the profile
+// store is configured to
+func storeProfiles(profileList []vpnProfile) {
 	profileJSON, err := json.Marshal(profileList)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 	fmt.Printf("Writing profile file to %s\n", vpnProfileFilePath)
-	writeError := ioutil.WriteFile(vpnProfileFilePath, profileJSON, 0755)
-	if writeError != nil {
-		fmt.Print("Could not write profile file\n")
-		log.Fatal(writeError)
-	}
-	fmt.Println("New profile saved!\n")
+	writeResourceFile(vpnProfileFilePath, encodeProfileStore(profileJSON))
+}
+
+func writeProfileFile(profileList []vpnProfile) {
+	storeProfiles(profileList)
+	fmt.Println("New profile saved!")
 }
 
 func printVPNProfileList() {
@@ -66,12 +77,24 @@ func printVPNProfileList() {
 			strconv.Itoa(index),
 			vpnProfile.Name,
 			vpnProfile.UserName,
+			vpnProfile.otpDescription(),
 		}
 		consoleTable.Append(row)
 	}
 	consoleTable.Render()
 }
 
+func (p vpnProfile) otpDescription() string {
+	switch {
+	case p.OTPMode == "":
+		return ""
+	case p.TOTPSeed == "":
+		return fmt.Sprintf("%s (prompt)", p.OTPMode)
+	default:
+		return fmt.Sprintf("%s (totp)", p.OTPMode)
+	}
+}
+
 func selectVPNProfileDetails(profileName string) vpnProfile {
 	vpnProfiles := loadProfileFile()
 	var selectedProfile vpnProfile
@@ -83,7 +106,20 @@ func selectVPNProfileDetails(profileName string) vpnProfile {
 	if selectedProfile.Name == "" {
 		log.Fatalf("VPN Profile: %s not found in %s", profileName, vpnProfileFilePath)
 	}
-	return selectedProfile
+	resolvedProfile, err := resolveProfileSecrets(selectedProfile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return resolvedProfile
+}
+
+func defaultHostForProfile(profileName string) string {
+	vpnProfiles := loadProfileFile()
+	defaultHost := vpnProfiles[profileIndex(vpnProfiles, profileName)].DefaultHost
+	if defaultHost == "" {
+		log.Fatalf("No VPN identifier provided and profile %s has no default host", profileName)
+	}
+	return defaultHost
 }
 
 func detectDuplicateName(providedName string) {
@@ -96,46 +132,140 @@ func detectDuplicateName(providedName string) {
 }
 
 func detailCapture(attr string) string {
-	var response string
 	fmt.Printf("%s ", attr)
-	_, err := fmt.Scanln(&response)
+	response, err := readStdinLine()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return strings.TrimSpace(response)
+}
+
+// secretCapture prompts for attr without echoing the response when stdin
+// is a terminal
+func secretCapture(attr string) string {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return detailCapture(attr)
+	}
+	fmt.Printf("%s ", attr)
+	response, err := term.ReadPassword(fd)
+	fmt.Println()
 	if err != nil {
-		if err.Error() == "unexpected newline" {
-			return ""
-		}
 		log.Fatal(err)
 	}
-	return response
+	return string(response)
 }
 
 func confirm() bool {
-	var returnVar bool
-	confirmation := detailCapture("Save Profile? [y/n]:")
-	switch confirmation {
-	case "y":
-		returnVar = true
-	case "n":
-		main()
-	default:
-		confirm()
+	for {
+		switch detailCapture("Save Profile? [y/n]:") {
+		case "y":
+			return true
+		case "n":
+			return false
+		}
 	}
-	return returnVar
 }
 
-func addProfile(profileName string) {
-	vpnProfiles := loadProfileFile()
-	detectDuplicateName(profileName)
+// profileInput holds the `profile add` flags used to create profiles
+// without prompting
+type profileInput struct {
+	userName      string
+	passwordStdin bool
+	pskFile       string
+	fromJSON      string
+}
+
+func (i profileInput) headless() bool {
+	return i.userName != "" || i.passwordStdin || i.pskFile != "" || i.fromJSON != ""
+}
+
+func captureProfile(profileName string) vpnProfile {
 	fmt.Printf("Please enter the following values to configure VPN profile %s\n", profileName)
 	username := detailCapture("USERNAME:")
-	password := detailCapture("PASSWORD:")
-	psk := detailCapture("PSK:")
-	if confirm() {
-		vpnProfiles = append(vpnProfiles,
-			vpnProfile{Name: profileName,
-				UserName: username,
-				PassWord: password,
-				Psk:      psk,
-			})
-		writeProfileFile(vpnProfiles)
+	password := secretCapture("PASSWORD:")
+	psk := secretCapture("PSK:")
+	otpMode := detailCapture("OTP MODE [none/append/substitute]:")
+	if otpMode == "none" {
+		otpMode = ""
+	}
+	if !validOTPMode(otpMode) {
+		log.Fatalf("unknown OTP mode %s", otpMode)
+	}
+	var totpSeed string
+	if otpMode != "" {
+		totpSeed = secretCapture("TOTP SEED (leave blank to be prompted when connecting):")
 	}
+	return vpnProfile{Name: profileName,
+		UserName: username,
+		PassWord: password,
+		Psk:      psk,
+		OTPMode:  otpMode,
+		TOTPSeed: totpSeed,
+	}
+}
+
+// headlessProfile builds a profile from a JSON document and flags, flags
+// take precedence over values in the document
+func headlessProfile(profileName string, input profileInput) vpnProfile {
+	var newProfile vpnProfile
+	if input.fromJSON != "" {
+		if input.fromJSON == "-" && input.passwordStdin {
+			log.Fatal("--from-json - and --password-stdin can not both read from stdin")
+		}
+		var profileJSON []byte
+		var err error
+		if input.fromJSON == "-" {
+			profileJSON, err = ioutil.ReadAll(stdinReader)
+		} else {
+			profileJSON, err = ioutil.ReadFile(input.fromJSON)
+		}
+		if err != nil {
+			log.Fatalf("Could not read profile JSON: %s", err)
+		}
+		err = json.Unmarshal(profileJSON, &newProfile)
+		if err != nil {
+			log.Fatalf("Could not parse profile JSON: %s", err)
+		}
+	}
+	newProfile.Name = profileName
+	if input.userName != "" {
+		newProfile.UserName = input.userName
+	}
+	if input.passwordStdin {
+		newProfile.PassWord = readStdinValue("password")
+	}
+	if input.pskFile != "" {
+		psk, err := ioutil.ReadFile(input.pskFile)
+		if err != nil {
+			log.Fatalf("Could not read PSK file: %s", err)
+		}
+		newProfile.Psk = strings.TrimRight(string(psk), "\r\n")
+	}
+	if newProfile.UserName == "" || newProfile.PassWord == "" || newProfile.Psk == "" {
+		log.Fatal("username, password and psk are all required to add a profile")
+	}
+	if !validOTPMode(newProfile.OTPMode) {
+		log.Fatalf("unknown OTP mode %s", newProfile.OTPMode)
+	}
+	return newProfile
+}
+
+func addProfile(profileName string, input profileInput) {
+	detectDuplicateName(profileName)
+	var newProfile vpnProfile
+	if input.headless() {
+		newProfile = headlessProfile(profileName, input)
+	} else {
+		newProfile = captureProfile(profileName)
+		if !confirm() {
+			return
+		}
+	}
+	//the details are captured before locking so other vpn processes are
+	//not held up by the prompts
+	unlock := lockResources()
+	defer unlock()
+	detectDuplicateName(profileName)
+	writeProfileFile(append(loadProfileFile(), newProfile))
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// stdinReader buffers stdin for every prompt and stdin flag, reading stdin
+// any other way would miss the input already buffered here
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// profileUpdate holds the `profile edit` flags, empty values leave the
+// profile's field unchanged
+type profileUpdate struct {
+	userName      string
+	passwordStdin bool
+	pskStdin      bool
+	otpMode       string
+}
+
+func (u profileUpdate) empty() bool {
+	return u.userName == "" && !u.passwordStdin && !u.pskStdin && u.otpMode == ""
+}
+
+// readStdinLine returns the next line of stdin without its line ending, a
+// last line without one is returned as is
+func readStdinLine() (string, error) {
+	line, err := stdinReader.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// readStdinValue reads the next line of stdin, values are read in flag
+// order: password then psk
+func readStdinValue(name string) string {
+	line, err := readStdinLine()
+	if err != nil {
+		log.Fatalf("Could not read %s from stdin: %s", name, err)
+	}
+	return line
+}
+
+// confirmAction asks the user to confirm prompt unless skip is set
+func confirmAction(prompt string, skip bool) bool {
+	if skip {
+		return true
+	}
+	return confirmUserSelection(fmt.Sprintf("%s [y/n]:", prompt))
+}
+
+// profileIndex returns the position of profileName in vpnProfiles
+func profileIndex(vpnProfiles []vpnProfile, profileName string) int {
+	for index, profile := range vpnProfiles {
+		if profile.Name == profileName {
+			return index
+		}
+	}
+	log.Fatalf("VPN Profile: %s not found in %s", profileName, vpnProfileFilePath)
+	return -1
+}
+
+// The profile edits below prompt before taking the resource lock, so other
+// vpn processes are not held up, and load the profiles again under it
+
+func removeProfile(profileName string, skipConfirm bool) {
+	profileIndex(loadProfileFile(), profileName)
+	if !confirmAction(fmt.Sprintf("Remove profile %s?", profileName), skipConfirm) {
+		fmt.Println("Profile not removed")
+		return
+	}
+	unlock := lockResources()
+	defer unlock()
+	vpnProfiles := loadProfileFile()
+	index := profileIndex(vpnProfiles, profileName)
+	vpnProfiles = append(vpnProfiles[:index], vpnProfiles[index+1:]...)
+	storeProfiles(vpnProfiles)
+	fmt.Printf("Profile %s removed\n", profileName)
+}
+
+func renameProfile(profileName string, newName string, skipConfirm bool) {
+	profileIndex(loadProfileFile(), profileName)
+	detectDuplicateName(newName)
+	if !confirmAction(fmt.Sprintf("Rename profile %s to %s?", profileName, newName), skipConfirm) {
+		fmt.Println("Profile not renamed")
+		return
+	}
+	unlock := lockResources()
+	defer unlock()
+	vpnProfiles := loadProfileFile()
+	index := profileIndex(vpnProfiles, profileName)
+	detectDuplicateName(newName)
+	vpnProfiles[index].Name = newName
+	storeProfiles(vpnProfiles)
+	for _, slot := range managedSlots() {
+		if session, found := loadSessionFile(slot); found && session.Profile == profileName {
+			session.Profile = newName
+			writeSessionFile(slot, session)
+		}
+	}
+	fmt.Printf("Profile %s renamed to %s\n", profileName, newName)
+}
+
+// captureProfileUpdate prompts for each field, blank answers keep the
+// current value
+func captureProfileUpdate(current vpnProfile) vpnProfile {
+	fmt.Printf("Enter new values for VPN profile %s, leave blank to keep the current value\n", current.Name)
+	updated := current
+	if username := detailCapture(fmt.Sprintf("USERNAME [%s]:", current.UserName)); username != "" {
+		updated.UserName = username
+	}
+	if password := secretCapture("PASSWORD:"); password != "" {
+		updated.PassWord = password
+	}
+	if psk := secretCapture("PSK:"); psk != "" {
+		updated.Psk = psk
+	}
+	return updated
+}
+
+func applyProfileUpdate(current vpnProfile, update profileUpdate) vpnProfile {
+	updated := current
+	if update.userName != "" {
+		updated.UserName = update.userName
+	}
+	if update.passwordStdin {
+		updated.PassWord = readStdinValue("password")
+	}
+	if update.pskStdin {
+		updated.Psk = readStdinValue("psk")
+	}
+	switch update.otpMode {
+	case "":
+	case "none":
+		updated.OTPMode = ""
+		updated.TOTPSeed = ""
+	default:
+		if !validOTPMode(update.otpMode) {
+			log.Fatalf("unknown OTP mode %s", update.otpMode)
+		}
+		updated.OTPMode = update.otpMode
+	}
+	return updated
+}
+
+func editProfile(profileName string, update profileUpdate, skipConfirm bool) {
+	current := loadProfileFile()
+	var updated vpnProfile
+	if update.empty() {
+		updated = captureProfileUpdate(current[profileIndex(current, profileName)])
+	} else {
+		updated = applyProfileUpdate(current[profileIndex(current, profileName)], update)
+	}
+	if !confirmAction(fmt.Sprintf("Save changes to profile %s?", profileName), skipConfirm) {
+		fmt.Println("Profile not changed")
+		return
+	}
+	unlock := lockResources()
+	defer unlock()
+	vpnProfiles := loadProfileFile()
+	vpnProfiles[profileIndex(vpnProfiles, profileName)] = updated
+	storeProfiles(vpnProfiles)
+	fmt.Printf("Profile %s updated\n", profileName)
+}
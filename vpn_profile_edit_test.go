@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"testing"
+)
+
+// pipeStdin feeds input to stdinReader through a pipe, as when it is piped
+// into vpn
+func pipeStdin(t *testing.T, input string) {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.WriteString(input); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	savedReader := stdinReader
+	stdinReader = bufio.NewReader(reader)
+	t.Cleanup(func() {
+		stdinReader = savedReader
+		reader.Close()
+	})
+}
+
+func TestEditProfilePasswordStdinWithConfirmation(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "confirmed", input: "newpw\ny\n", want: "newpw"},
+		{name: "confirmed without trailing newline", input: "newpw\ny", want: "newpw"},
+		{name: "asked again", input: "newpw\nmaybe\ny\n", want: "newpw"},
+		{name: "declined", input: "newpw\nn\n", want: testProfile.PassWord},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestResources(t)
+			storeProfiles([]vpnProfile{testProfile})
+			pipeStdin(t, test.input)
+
+			editProfile("test", profileUpdate{passwordStdin: true}, false)
+
+			if got := loadProfileFile()[0].PassWord; got != test.want {
+				t.Errorf("password = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCaptureProfileUpdateReadsPipedAnswers(t *testing.T) {
+	useTestResources(t)
+	pipeStdin(t, "bob\n\npsk2\n")
+
+	updated := captureProfileUpdate(testProfile)
+
+	if updated.UserName != "bob" || updated.PassWord != testProfile.PassWord || updated.Psk != "psk2" {
+		t.Errorf("updated = %+v", updated)
+	}
+}
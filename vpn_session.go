@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+var sessionFilePath = path.Join(resourcePath, "session.json")
+
+// connectionSession records the managed connection established by
+// startConnection so later commands don't have to infer it
+type connectionSession struct {
+	VpcID      string    `json:"vpc_id"`
+	Name       string    `json:"name"`
+	PublicIP   string    `json:"public_ip"`
+	AWSProfile string    `json:"aws_profile"`
+	Region     string    `json:"region"`
+	InstanceID string    `json:"instance_id"`
+	Profile    string    `json:"profile"`
+	Routes     []string  `json:"routes"`
+	Interface  string    `json:"interface"`
+	StartedAt  time.Time `json:"started_at"`
+	Slot       string    `json:"slot"`
+	PID        int       `json:"pid"`
+}
+
+func newConnectionSession(slot connectionSlot, vpnHost vpnInstance, profileName string, routes []string) connectionSession {
+	session := connectionSession{
+		VpcID:      vpnHost.VpcID,
+		Name:       vpnHost.Name,
+		PublicIP:   vpnHost.PublicIP,
+		AWSProfile: vpnHost.AWSProfile,
+		Region:     vpnHost.Region,
+		InstanceID: vpnHost.InstanceID,
+		Profile:    profileName,
+		Routes:     routes,
+		StartedAt:  time.Now(),
+		PID:        os.Getpid(),
+		Slot:       slot.Name,
+	}
+	if status, err := slot.backend().Status(); err == nil {
+		session.Interface = status.Interface
+	}
+	return session
+}
+
+func (s connectionSession) matches(vpnHost vpnInstance) bool {
+	return s.VpcID == vpnHost.VpcID && s.PublicIP == vpnHost.PublicIP && s.InstanceID == vpnHost.InstanceID
+}
+
+// identifiedBy reports whether identifier names the session's host by name,
+// instance ID, VPC ID or public IP
+func (s connectionSession) identifiedBy(identifier string) bool {
+	switch identifier {
+	case s.Name, s.InstanceID, s.VpcID, s.PublicIP:
+		return true
+	}
+	return false
+}
+
+// host rebuilds the connected vpnInstance for hosts no longer in the host file
+func (s connectionSession) host() vpnInstance {
+	return vpnInstance{
+		VpcID:      s.VpcID,
+		Name:       s.Name,
+		PublicIP:   s.PublicIP,
+		AWSProfile: s.AWSProfile,
+		Region:     s.Region,
+		InstanceID: s.InstanceID,
+	}
+}
+
+// loadSessionFile returns the session recorded for slot and whether one
+// exists
+func loadSessionFile(slot connectionSlot) (connectionSession, bool) {
+	var session connectionSession
+	sessionPath := slot.sessionPath()
+	file, e := ioutil.ReadFile(sessionPath)
+	if e != nil {
+		if os.IsNotExist(e) {
+			return session, false
+		}
+		log.Fatalf("Could not read session file %s: %s", sessionPath, e)
+	}
+	err := json.Unmarshal(file, &session)
+	if err != nil {
+		log.Fatalf("Could not parse session file %s: %s", sessionPath, err)
+	}
+	return session, true
+}
+
+func writeSessionFile(slot connectionSlot, session connectionSession) {
+	sessionPath := slot.sessionPath()
+	sessionJSON, err := json.Marshal(session)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	unlock := lockResources()
+	defer unlock()
+	writeError := writeFileAtomic(sessionPath, sessionJSON, 0600)
+	if writeError != nil {
+		fmt.Printf("Could not write session file to path %s\n", sessionPath)
+		log.Fatal(writeError)
+	}
+}
+
+func clearSessionFile(slot connectionSlot) {
+	unlock := lockResources()
+	defer unlock()
+	err := os.Remove(slot.sessionPath())
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Could not remove session file %s: %s", slot.sessionPath(), err)
+	}
+}
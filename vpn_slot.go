@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"strings"
+)
+
+const (
+	//connecting is refused when a VPC overlaps a connected VPC
+	overlapRefuse = "refuse"
+	//connecting goes ahead after the overlapping ranges are reported
+	overlapWarn = "warn"
+)
+
+// connectionSlot is one of the managed connections that can be up at the
+// same time. Each slot has its own VPN configuration, endpoint host name and
+// session file, the first slot uses the names from before slots existed
+type connectionSlot struct {
+	Index int
+	Name  string
+	Host  string
+}
+
+func managedSlot(index int) connectionSlot {
+	if index == 0 {
+		return connectionSlot{Index: 0, Name: managedName, Host: managedHost}
+	}
+	number := index + 1
+	host := fmt.Sprintf("%s-%d", managedHost, number)
+	if dot := strings.Index(managedHost, "."); dot > 0 {
+		host = fmt.Sprintf("%s-%d%s", managedHost[:dot], number, managedHost[dot:])
+	}
+	return connectionSlot{
+		Index: index,
+		Name:  fmt.Sprintf("%s_%d", managedName, number),
+		Host:  host,
+	}
+}
+
+func managedSlots() []connectionSlot {
+	var slots []connectionSlot
+	for index := 0; index < config.MaxConnections; index++ {
+		slots = append(slots, managedSlot(index))
+	}
+	return slots
+}
+
+func (s connectionSlot) backend() VPNBackend {
+	return selectBackend(config.Backend, s)
+}
+
+// sessionPath is session.json for the first slot and session_<n>.json for
+// the others
+func (s connectionSlot) sessionPath() string {
+	if s.Index == 0 {
+		return sessionFilePath
+	}
+	base := strings.TrimSuffix(path.Base(sessionFilePath), ".json")
+	return path.Join(path.Dir(sessionFilePath), fmt.Sprintf("%s_%d.json", base, s.Index+1))
+}
+
+// inUse reports whether the slot holds a connection, either recorded in its
+// session or reported by the backend
+func (s connectionSlot) inUse() bool {
+	if _, found := loadSessionFile(s); found {
+		return true
+	}
+	backend := s.backend()
+	if !backend.Show() {
+		return false
+	}
+	status, err := backend.Status()
+	return err == nil && status.State != stateDisconnected
+}
+
+// slotsInUse returns the slots holding a connection
+func slotsInUse() []connectionSlot {
+	var inUse []connectionSlot
+	for _, slot := range managedSlots() {
+		if slot.inUse() {
+			inUse = append(inUse, slot)
+		}
+	}
+	return inUse
+}
+
+// selectSlot picks the slot to connect vpnHost in. A slot already holding
+// vpnHost is reused, otherwise keepExisting takes the first free slot and
+// the first slot is used when existing connections are being replaced
+func selectSlot(vpnHost vpnInstance, keepExisting bool) connectionSlot {
+	for _, slot := range managedSlots() {
+		if session, found := loadSessionFile(slot); found && session.matches(vpnHost) {
+			return slot
+		}
+	}
+	if !keepExisting {
+		return managedSlot(0)
+	}
+	for _, slot := range managedSlots() {
+		if !slot.inUse() {
+			return slot
+		}
+	}
+	log.Fatalf("All %d connection slots are in use, disconnect a host or raise max_connections", config.MaxConnections)
+	return connectionSlot{}
+}
+
+func cidrsOverlap(a string, b string) bool {
+	_, networkA, errA := net.ParseCIDR(a)
+	_, networkB, errB := net.ParseCIDR(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	return networkA.Contains(networkB.IP) || networkB.Contains(networkA.IP)
+}
+
+// overlappingRoutes describes the routes of connections in other slots that
+// overlap cidrs
+func overlappingRoutes(current connectionSlot, cidrs []string) []string {
+	var overlaps []string
+	for _, slot := range managedSlots() {
+		if slot.Index == current.Index {
+			continue
+		}
+		session, found := loadSessionFile(slot)
+		if !found {
+			continue
+		}
+		for _, route := range session.Routes {
+			for _, cidr := range cidrs {
+				if cidrsOverlap(route, cidr) {
+					overlaps = append(overlaps, fmt.Sprintf("%s overlaps %s routed to %s (%s)", cidr, route, session.Name, slot.Name))
+				}
+			}
+		}
+	}
+	return overlaps
+}
+
+// checkOverlappingRoutes refuses, or warns about, connecting to a host whose
+// VPC shares address ranges with an already connected VPC
+func checkOverlappingRoutes(slot connectionSlot, vpnHost vpnInstance, includeIPv6 bool) {
+	cidrs := vpnHost.cidrBlocks()
+	if includeIPv6 {
+		cidrs = append(cidrs, vpnHost.VpcIpv6Cidrs...)
+	}
+	overlaps := overlappingRoutes(slot, cidrs)
+	if len(overlaps) == 0 {
+		return
+	}
+	for _, overlap := range overlaps {
+		fmt.Println(overlap)
+	}
+	if config.OverlappingRoutes == overlapWarn {
+		fmt.Println("Warning: traffic to overlapping ranges may be routed to either VPC")
+		return
+	}
+	log.Fatalf("Refusing to connect to %s, set overlapping_routes to warn to connect anyway", vpnHost.Name)
+}
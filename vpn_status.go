@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/olekukonko/tablewriter"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+type connectionState string
+
+const (
+	stateConnecting    connectionState = "connecting"
+	stateConnected     connectionState = "connected"
+	stateDisconnecting connectionState = "disconnecting"
+	stateDisconnected  connectionState = "disconnected"
+	stateError         connectionState = "error"
+)
+
+// connectionStatus is the state of the managed connection as reported by
+// the VPN backend
+type connectionStatus struct {
+	State       connectionState
+	Interface   string
+	ConnectedAt time.Time
+	UserName    string
+	Routes      []string
+}
+
+type statusReport struct {
+	Connection  string          `json:"connection"`
+	State       connectionState `json:"state"`
+	Host        *vpnInstance    `json:"host,omitempty"`
+	Profile     string          `json:"profile,omitempty"`
+	ConnectedAt *time.Time      `json:"connected_at,omitempty"`
+	Interface   string          `json:"interface,omitempty"`
+	Routes      []string        `json:"routes"`
+	Error       string          `json:"error,omitempty"`
+}
+
+// managedHostIP returns the address the slot's host name currently points
+// to in the hosts file, the hosts file is not used in the direct endpoint mode
+func managedHostIP(slot connectionSlot) string {
+	if config.EndpointMode == endpointModeDirect {
+		return ""
+	}
+	hosts, err := loadHostsFile(config.HostsFile)
+	if err != nil {
+		log.Fatalf("Could not read hosts file %s: %s", config.HostsFile, err)
+	}
+	return hosts.address(slot.Host)
+}
+
+func findHostByIP(ip string) *vpnInstance {
+	if ip == "" {
+		return nil
+	}
+	if _, err := os.Stat(hostFilePath); os.IsNotExist(err) {
+		return nil
+	}
+	for _, host := range readHostsJSONFile() {
+		if host.PublicIP == ip {
+			return &host
+		}
+	}
+	return nil
+}
+
+// findProfileNamesByUser returns the profiles configured with the username
+// the backend is connecting as
+func findProfileNamesByUser(userName string) string {
+	if userName == "" {
+		return ""
+	}
+	var names []string
+	for _, profile := range loadProfileFile() {
+		if profile.UserName == userName {
+			names = append(names, profile.Name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func buildStatusReport(slot connectionSlot) statusReport {
+	report := statusReport{Connection: slot.Name, Routes: []string{}}
+	status, err := slot.backend().Status()
+	if err != nil {
+		report.State = stateError
+		report.Error = err.Error()
+		return report
+	}
+	report.State = status.State
+	if status.State == stateDisconnected {
+		return report
+	}
+	report.Interface = status.Interface
+	if status.Routes != nil {
+		report.Routes = status.Routes
+	}
+	if session, found := loadSessionFile(slot); found {
+		report.Host = findHostByIP(session.PublicIP)
+		if report.Host == nil {
+			host := session.host()
+			report.Host = &host
+		}
+		report.Profile = session.Profile
+		report.ConnectedAt = &session.StartedAt
+		if report.Interface == "" {
+			report.Interface = session.Interface
+		}
+		return report
+	}
+	//connections established before sessions were recorded fall back to
+	//the hosts file entry and backend details
+	report.Host = findHostByIP(managedHostIP(slot))
+	report.Profile = findProfileNamesByUser(status.UserName)
+	if !status.ConnectedAt.IsZero() {
+		report.ConnectedAt = &status.ConnectedAt
+	}
+	return report
+}
+
+func printStatusJSON(reports []statusReport) {
+	reportJSON, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(reportJSON))
+}
+
+func printStatusTable(report statusReport) {
+	rows := [][]string{{"Connection", report.Connection}, {"State", string(report.State)}}
+	if report.Error != "" {
+		rows = append(rows, []string{"Error", report.Error})
+	}
+	if report.Host != nil {
+		rows = append(rows,
+			[]string{"VPN Name", report.Host.Name},
+			[]string{"VPC ID", report.Host.VpcID},
+			[]string{"Environment", report.Host.Environment},
+			[]string{"Public IP", report.Host.PublicIP},
+			[]string{"AWS Profile", report.Host.AWSProfile},
+			[]string{"Region", report.Host.Region},
+			[]string{"Instance ID", report.Host.InstanceID},
+		)
+	}
+	if report.Profile != "" {
+		rows = append(rows, []string{"Profile", report.Profile})
+	}
+	if report.ConnectedAt != nil {
+		rows = append(rows, []string{"Connected At", report.ConnectedAt.Local().Format(time.RFC1123)})
+	}
+	if report.Interface != "" {
+		rows = append(rows, []string{"Interface", report.Interface})
+	}
+	if len(report.Routes) > 0 {
+		rows = append(rows, []string{"Routes", strings.Join(report.Routes, "\n")})
+	}
+	consoleTable := tablewriter.NewWriter(os.Stdout)
+	consoleTable.AppendBulk(rows)
+	consoleTable.Render()
+}
+
+// printConnectionStatus reports on the first slot and every other slot
+// holding a connection
+func printConnectionStatus(output string) {
+	var reports []statusReport
+	for _, slot := range managedSlots() {
+		if slot.Index == 0 || slot.inUse() {
+			reports = append(reports, buildStatusReport(slot))
+		}
+	}
+	switch output {
+	case "json":
+		printStatusJSON(reports)
+	default:
+		for _, report := range reports {
+			printStatusTable(report)
+		}
+	}
+}
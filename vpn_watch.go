@@ -0,0 +1,241 @@
+package main
+
+import (
+	"golang.org/x/term"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+type watchConfig struct {
+	Interval   time.Duration `yaml:"interval"`
+	MinBackoff time.Duration `yaml:"min_backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+// watchedConnection is a connection the watchdog keeps up, its profile is
+// resolved when watching starts so reconnecting does not prompt
+type watchedConnection struct {
+	slot        connectionSlot
+	session     connectionSession
+	profile     vpnProfile
+	state       connectionState
+	backoff     time.Duration
+	nextAttempt time.Time
+}
+
+// watchdog polls the backend for each watched connection and reconnects the
+// ones that drop
+type watchdog struct {
+	connections []*watchedConnection
+	stop        chan os.Signal
+	stopped     bool
+}
+
+func newWatchdog(slots []connectionSlot) *watchdog {
+	w := &watchdog{stop: make(chan os.Signal, 1)}
+	profiles := make(map[string]vpnProfile)
+	for _, slot := range slots {
+		session, found := loadSessionFile(slot)
+		if !found {
+			continue
+		}
+		profile, resolved := profiles[session.Profile]
+		if !resolved {
+			profile = watchProfile(session.Profile)
+			profiles[session.Profile] = profile
+		}
+		w.connections = append(w.connections, &watchedConnection{
+			slot:    slot,
+			session: session,
+			profile: profile,
+			state:   stateConnected,
+		})
+	}
+	return w
+}
+
+// watchProfile resolves a profile for the watchdog, prompting for the
+// profile store passphrase now rather than on the first reconnect. A one
+// time password that can not be generated or prompted for fails here
+func watchProfile(profileName string) vpnProfile {
+	profile := selectVPNProfileDetails(profileName)
+	if profile.OTPMode != "" && profile.TOTPSeed == "" && !term.IsTerminal(int(os.Stdin.Fd())) {
+		log.Fatalf("Profile %s prompts for a one time password on every reconnect but stdin is not a terminal, store a TOTP seed in the profile to watch it unattended", profileName)
+	}
+	return profile
+}
+
+// watchConnections keeps the connections to identifier, or every recorded
+// connection, up until interrupted
+func watchConnections(identifier string) {
+	var slots []connectionSlot
+	for _, slot := range managedSlots() {
+		session, found := loadSessionFile(slot)
+		if found && (identifier == "" || slot.Name == identifier || session.identifiedBy(identifier)) {
+			slots = append(slots, slot)
+		}
+	}
+	if len(slots) == 0 {
+		log.Fatal("No managed VPN connections to watch, connect first")
+	}
+	newWatchdog(slots).run()
+}
+
+// sleep waits for d and reports false when a stop signal arrived first
+func (w *watchdog) sleep(d time.Duration) bool {
+	select {
+	case sig := <-w.stop:
+		log.Printf("Received %s, stopping watch", sig)
+		w.stopped = true
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func (w *watchdog) run() {
+	signal.Notify(w.stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(w.stop)
+	for _, watched := range w.connections {
+		log.Printf("Watching %s (%s)", watched.session.Name, watched.slot.Name)
+	}
+	for len(w.connections) > 0 {
+		var remaining []*watchedConnection
+		for _, watched := range w.connections {
+			if w.check(watched) {
+				remaining = append(remaining, watched)
+			}
+			if w.stopped {
+				return
+			}
+		}
+		w.connections = remaining
+		if !w.sleep(config.Watch.Interval) {
+			return
+		}
+	}
+	log.Print("No connections left to watch")
+}
+
+// check polls a watched connection, reconnecting it when it has dropped,
+// and reports whether it should still be watched
+func (w *watchdog) check(watched *watchedConnection) bool {
+	session, found := loadSessionFile(watched.slot)
+	if !found || !session.matches(watched.session.host()) {
+		log.Printf("%s (%s) was disconnected, no longer watching it", watched.session.Name, watched.slot.Name)
+		return false
+	}
+	watched.session = session
+	state := stateError
+	status, err := watched.slot.backend().Status()
+	if err == nil {
+		state = status.State
+	}
+	watched.transition(state)
+	switch state {
+	case stateConnected:
+		watched.backoff = 0
+	case stateDisconnected, stateError:
+		if time.Now().After(watched.nextAttempt) {
+			return w.reconnect(watched)
+		}
+	}
+	return true
+}
+
+func (c *watchedConnection) transition(state connectionState) {
+	if state != c.state {
+		log.Printf("%s (%s): %s -> %s", c.session.Name, c.slot.Name, c.state, state)
+		c.state = state
+	}
+}
+
+// scheduleRetry doubles the backoff, between watch.min_backoff and
+// watch.max_backoff, before the next reconnect attempt
+func (c *watchedConnection) scheduleRetry() {
+	c.backoff *= 2
+	if c.backoff < config.Watch.MinBackoff {
+		c.backoff = config.Watch.MinBackoff
+	}
+	if c.backoff > config.Watch.MaxBackoff {
+		c.backoff = config.Watch.MaxBackoff
+	}
+	c.nextAttempt = time.Now().Add(c.backoff)
+	log.Printf("%s (%s): retrying in %s", c.session.Name, c.slot.Name, c.backoff)
+}
+
+// reconnect brings the connection back up with the host and profile it was
+// established with and reinstalls its routes, it reports false when the
+// connection was disconnected meanwhile and should no longer be watched
+func (w *watchdog) reconnect(watched *watchedConnection) bool {
+	vpnHost := watched.session.host()
+	if host := findHostByIP(watched.session.PublicIP); host != nil {
+		vpnHost = *host
+	}
+	log.Printf("%s (%s): reconnecting", vpnHost.Name, watched.slot.Name)
+	backend := watched.slot.backend()
+	if config.EndpointMode == endpointModeHosts {
+		updateManagedVPNHost(watched.slot, vpnHost, false)
+	}
+	//clear out whatever is left of the dropped tunnel before starting again,
+	//there may be nothing to stop
+	_ = backend.Stop()
+	err := backend.Start(applyOTP(watched.profile), vpnHost)
+	if err != nil {
+		log.Printf("%s (%s): %s", vpnHost.Name, watched.slot.Name, err)
+		watched.transition(stateError)
+		watched.scheduleRetry()
+		return true
+	}
+	watched.transition(stateConnecting)
+	deadline := time.Now().Add(config.ConnectTimeout)
+	for {
+		if status, err := backend.Status(); err == nil && status.State == stateConnected {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Printf("%s (%s): connection not established after %s", vpnHost.Name, watched.slot.Name, config.ConnectTimeout)
+			watched.scheduleRetry()
+			return true
+		}
+		if !w.sleep(config.ConnectPollInterval) {
+			return true
+		}
+	}
+	//disconnect clears the session under the lock, make sure it is still
+	//there before writing it back
+	unlock := lockResources()
+	defer unlock()
+	session, found := loadSessionFile(watched.slot)
+	if !found || !session.matches(watched.session.host()) {
+		log.Printf("%s (%s) was disconnected while reconnecting, no longer watching it", vpnHost.Name, watched.slot.Name)
+		_ = backend.Stop()
+		return false
+	}
+	watched.transition(stateConnected)
+	watched.backoff = 0
+	reinstallRouting(backend, watched.session.Routes)
+	watched.session.StartedAt = time.Now()
+	if status, err := backend.Status(); err == nil {
+		watched.session.Interface = status.Interface
+	}
+	writeSessionFile(watched.slot, watched.session)
+	return true
+}
+
+// reinstallRouting adds the routes recorded for a connection after it has
+// been re-established, routes that fail stay recorded so disconnect still
+// cleans them up
+func reinstallRouting(backend VPNBackend, routes []string) {
+	for _, route := range routes {
+		err := backend.AddRoute(route)
+		if err != nil {
+			log.Printf("Could not reinstall route to %s: %s", route, err)
+			continue
+		}
+		log.Printf("Reinstalled route to %s", route)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWatchdogReconnectsWithResolvedProfile(t *testing.T) {
+	network := setupFakeConnections(t)
+	t.Setenv("VPN_TEST_PSK", "from-env")
+	profile := testProfile
+	profile.Psk = "secret://env:VPN_TEST_PSK"
+	storeProfiles([]vpnProfile{profile})
+	startConnection("alpha", "test", connectOptions{})
+	slot := managedSlot(0)
+	w := newWatchdog([]connectionSlot{slot})
+	//the reference is only resolved when watching starts
+	os.Unsetenv("VPN_TEST_PSK")
+	var started []vpnProfile
+	network.onStart = func(slot connectionSlot, vpnDetails vpnProfile) {
+		started = append(started, vpnDetails)
+	}
+	network.states[slot.Name] = stateDisconnected
+	network.routes[slot.Name] = nil
+
+	if !w.check(w.connections[0]) {
+		t.Fatal("check stopped watching the connection")
+	}
+
+	if len(started) != 1 || started[0].Psk != "from-env" {
+		t.Errorf("started with %+v, want the resolved psk", started)
+	}
+	if network.states[slot.Name] != stateConnected {
+		t.Errorf("state = %s, want connected", network.states[slot.Name])
+	}
+	if want := []string{"10.1.0.0/16"}; !reflect.DeepEqual(network.routes[slot.Name], want) {
+		t.Errorf("routes = %v, want %v", network.routes[slot.Name], want)
+	}
+}
+
+func TestWatchdogStopsWhenDisconnectedWhileReconnecting(t *testing.T) {
+	network := setupFakeConnections(t)
+	startConnection("alpha", "test", connectOptions{})
+	slot := managedSlot(0)
+	w := newWatchdog([]connectionSlot{slot})
+	//disconnect clears the session first, before stopping the connection
+	network.onStart = func(slot connectionSlot, vpnDetails vpnProfile) {
+		clearSessionFile(slot)
+	}
+	network.states[slot.Name] = stateDisconnected
+	network.routes[slot.Name] = nil
+
+	if w.check(w.connections[0]) {
+		t.Error("check kept watching a disconnected connection")
+	}
+
+	if _, found := loadSessionFile(slot); found {
+		t.Error("the session was written back after disconnecting")
+	}
+	if network.states[slot.Name] != stateDisconnected {
+		t.Errorf("state = %s, want the reconnected tunnel stopped", network.states[slot.Name])
+	}
+	if len(network.routes[slot.Name]) != 0 {
+		t.Errorf("routes %v were reinstalled", network.routes[slot.Name])
+	}
+}
+
+// TestWatchProfileRequiresUnattendedOTP runs newWatchdog in a child process,
+// without a terminal on stdin, as it exits
+func TestWatchProfileRequiresUnattendedOTP(t *testing.T) {
+	if os.Getenv("VPN_TEST_WATCH_OTP") != "" {
+		setupFakeConnections(t)
+		profile := testProfile
+		profile.OTPMode = otpModeAppend
+		storeProfiles([]vpnProfile{profile})
+		writeSessionFile(managedSlot(0), sessionFor(testHost("alpha", "203.0.113.10", "10.1.0.0/16")))
+		newWatchdog([]connectionSlot{managedSlot(0)})
+		t.Fatal("newWatchdog returned")
+	}
+	child := exec.Command(os.Args[0], "-test.run=^TestWatchProfileRequiresUnattendedOTP$")
+	child.Env = append(os.Environ(), "VPN_TEST_WATCH_OTP=1")
+	output, err := child.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Fatalf("newWatchdog exited with %v, want 1\n%s", err, output)
+	}
+	if want := "store a TOTP seed in the profile to watch it unattended"; !strings.Contains(string(output), want) {
+		t.Errorf("output = %q, want it to contain %q", output, want)
+	}
+}